@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AgentCheckResult struct {
+	Host       string      `json:"host"`
+	Check      string      `json:"check"`
+	InstanceId interface{} `json:"instance_id"`
+	Status     string      `json:"status"`
+	Message    string      `json:"message"`
+	Timestamp  time.Time   `json:"timestamp"`
+}
+
+// AgentCheckSummary keeps the latest agent_checks result per host and check
+// instance.
+type AgentCheckSummary struct {
+	sync.Mutex
+	results map[string]*AgentCheckResult
+}
+
+var agentChecks = &AgentCheckSummary{results: make(map[string]*AgentCheckResult)}
+
+func joinCheckMessage(value interface{}) string {
+	messages, ok := value.([]interface{})
+	if !ok {
+		message, _ := value.(string)
+		return message
+	}
+	message := ""
+	for _, msg := range messages {
+		if len(message) > 0 {
+			message += "\n"
+		}
+		message += msg.(string)
+	}
+	return message
+}
+
+func (self *AgentCheckSummary) Update(result *AgentCheckResult) {
+	self.Lock()
+	defer self.Unlock()
+
+	key := fmt.Sprintf("%s|%s|%v", result.Host, result.Check, result.InstanceId)
+	self.results[key] = result
+}
+
+func (self *AgentCheckSummary) Results(status string) []*AgentCheckResult {
+	self.Lock()
+	defer self.Unlock()
+
+	keys := make([]string, 0, len(self.results))
+	for key, result := range self.results {
+		if len(status) == 0 || strings.EqualFold(result.Status, status) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	results := make([]*AgentCheckResult, len(keys))
+	for i, key := range keys {
+		result := *self.results[key]
+		results[i] = &result
+	}
+	return results
+}
+
+func handleAgentChecks(w http.ResponseWriter, req *http.Request) {
+	_, handled := handleApiKey(w, req)
+	if handled {
+		return
+	}
+	writeJSON(w, agentChecks.Results(req.Form.Get("status")))
+}
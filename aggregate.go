@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AggregateRule combines the latest value of a field from every series
+// matching Metric, grouped by the GroupBy tags, into one series per group.
+type AggregateRule struct {
+	Name      string   `json:"name"`
+	Metric    *Pattern `json:"metric"`
+	Field     string   `json:"field"`
+	GroupBy   []string `json:"group_by"`
+	Functions []string `json:"functions"`
+
+	groups map[string]*aggregateGroup
+}
+
+type aggregateGroup struct {
+	tags   map[string]string
+	values map[string]float64
+}
+
+type Aggregator struct {
+	sync.Mutex
+	Rules []*AggregateRule
+}
+
+var aggregator *Aggregator
+
+func LoadAggregator(path string) (*Aggregator, error) {
+	rules := []*AggregateRule{}
+	err := loadJSONConfig(path, &rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.Metric == nil || len(rule.Field) == 0 {
+			return nil, fmt.Errorf("aggregate rule needs a metric and a field")
+		}
+		if len(rule.Name) == 0 {
+			return nil, fmt.Errorf("aggregate rule for %s needs a name", rule.Field)
+		}
+		if len(rule.Functions) == 0 {
+			rule.Functions = []string{"sum", "avg"}
+		}
+		for _, function := range rule.Functions {
+			if _, err := aggregateFunction(function, []float64{0}); err != nil {
+				return nil, err
+			}
+		}
+		rule.groups = make(map[string]*aggregateGroup)
+	}
+	return &Aggregator{Rules: rules}, nil
+}
+
+func (self *Aggregator) Add(metrics []*Metric) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, rule := range self.Rules {
+		for _, metric := range metrics {
+			if !rule.Metric.MatchString(metric.Name) {
+				continue
+			}
+			for _, point := range metric.Points {
+				field, ok := point.Fields[rule.Field]
+				if !ok {
+					continue
+				}
+				value, ok := field.Float()
+				if !ok {
+					continue
+				}
+				tags := make(map[string]string)
+				keys := make([]string, len(rule.GroupBy))
+				for i, tag := range rule.GroupBy {
+					if v, ok := point.Lookup(tag); ok {
+						tags[tag] = v
+						keys[i] = v
+					}
+				}
+				key := strings.Join(keys, "\x00")
+				group, ok := rule.groups[key]
+				if !ok {
+					group = &aggregateGroup{tags, make(map[string]float64)}
+					rule.groups[key] = group
+				}
+				group.values[point.SeriesKey(metric.Name)] = value
+			}
+		}
+	}
+}
+
+func percentile(values []float64, p float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func aggregateFunction(name string, values []float64) (float64, error) {
+	switch name {
+	case "sum", "avg":
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		if name == "avg" {
+			return sum / float64(len(values)), nil
+		}
+		return sum, nil
+	case "min":
+		min := math.Inf(1)
+		for _, value := range values {
+			min = math.Min(min, value)
+		}
+		return min, nil
+	case "max":
+		max := math.Inf(-1)
+		for _, value := range values {
+			max = math.Max(max, value)
+		}
+		return max, nil
+	case "count":
+		return float64(len(values)), nil
+	}
+	if strings.HasPrefix(name, "p") {
+		p, err := strconv.ParseFloat(name[1:], 64)
+		if err == nil && p > 0 && p <= 100 {
+			return percentile(values, p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown aggregate function: %q", name)
+}
+
+func (self *Aggregator) Flush(now time.Time) []*Metric {
+	self.Lock()
+	defer self.Unlock()
+
+	timestamp := timeToTimestamp(now)
+	metrics := []*Metric{}
+	for _, rule := range self.Rules {
+		if len(rule.groups) == 0 {
+			continue
+		}
+		metric := NewMetric(rule.Name)
+		for _, group := range rule.groups {
+			values := make([]float64, 0, len(group.values))
+			for _, value := range group.values {
+				values = append(values, value)
+			}
+			point := NewPoint(timestamp, "")
+			for k, v := range group.tags {
+				point.Tags[k] = v
+			}
+			for _, function := range rule.Functions {
+				result, _ := aggregateFunction(function, values)
+				point.SetField(function, result)
+			}
+			metric.Add(point)
+		}
+		metrics = append(metrics, metric)
+		rule.groups = make(map[string]*aggregateGroup)
+	}
+	return metrics
+}
+
+func (self *Aggregator) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		metrics := self.Flush(now)
+		if len(metrics) > 0 {
+			log.Printf("Flushing %d aggregate series\n", len(metrics))
+			PushMetrics(metrics)
+		}
+	}
+}
+
+func aggregateMetrics(metrics []*Metric) {
+	if aggregator != nil {
+		aggregator.Add(metrics)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	AlertOK   = "OK"
+	AlertWarn = "WARN"
+	AlertCrit = "CRIT"
+)
+
+// AlertRule compares Field of every series matching Metric against the Warn
+// and Crit thresholds. A series has to stay past a threshold for For before
+// the rule changes state; recovering to a lower state happens immediately.
+type AlertRule struct {
+	Name   string   `json:"name"`
+	Metric *Pattern `json:"metric"`
+	Field  string   `json:"field"`
+	Op     string   `json:"op"`
+	Warn   *float64 `json:"warn"`
+	Crit   *float64 `json:"crit"`
+	For    string   `json:"for"`
+
+	duration time.Duration
+}
+
+type AlertState struct {
+	Rule      string            `json:"rule"`
+	Metric    string            `json:"metric"`
+	Tags      map[string]string `json:"tags"`
+	State     string            `json:"state"`
+	Value     float64           `json:"value"`
+	Since     time.Time         `json:"since"`
+	LastValue time.Time         `json:"last_value"`
+
+	pending      string
+	pendingSince time.Time
+}
+
+type AlertNotification struct {
+	Rule      string            `json:"rule"`
+	Metric    string            `json:"metric"`
+	Tags      map[string]string `json:"tags"`
+	From      string            `json:"from"`
+	To        string            `json:"to"`
+	Value     float64           `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+	Message   string            `json:"message"`
+}
+
+// Alerter keeps the state of every rule and series. States of series that
+// haven't had a value within StaleAfter are forgotten.
+type Alerter struct {
+	sync.Mutex
+	Rules      []*AlertRule
+	Webhooks   []string
+	StaleAfter time.Duration
+
+	states    map[string]*AlertState
+	lastSweep time.Time
+}
+
+var alerter *Alerter
+
+func LoadAlerter(path string, webhooks []string, staleAfter time.Duration) (*Alerter, error) {
+	rules := []*AlertRule{}
+	err := loadJSONConfig(path, &rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if rule.Metric == nil || len(rule.Field) == 0 {
+			return nil, fmt.Errorf("alert rule %q needs a metric and a field", rule.Name)
+		}
+		if rule.Warn == nil && rule.Crit == nil {
+			return nil, fmt.Errorf("alert rule %q needs a warn or crit threshold", rule.Name)
+		}
+		if _, err := compare(rule.Op, 0, 0); err != nil {
+			return nil, err
+		}
+		if len(rule.For) > 0 {
+			rule.duration, err = time.ParseDuration(rule.For)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return NewAlerter(rules, webhooks, staleAfter), nil
+}
+
+func NewAlerter(rules []*AlertRule, webhooks []string, staleAfter time.Duration) *Alerter {
+	return &Alerter{
+		Rules:      rules,
+		Webhooks:   webhooks,
+		StaleAfter: staleAfter,
+		states:     make(map[string]*AlertState),
+		lastSweep:  time.Now(),
+	}
+}
+
+func compare(op string, value, threshold float64) (bool, error) {
+	switch op {
+	case ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case "==":
+		return value == threshold, nil
+	case "!=":
+		return value != threshold, nil
+	}
+	return false, fmt.Errorf("unknown alert operator: %q", op)
+}
+
+func (self *AlertRule) level(value float64) string {
+	if self.Crit != nil {
+		if ok, _ := compare(self.Op, value, *self.Crit); ok {
+			return AlertCrit
+		}
+	}
+	if self.Warn != nil {
+		if ok, _ := compare(self.Op, value, *self.Warn); ok {
+			return AlertWarn
+		}
+	}
+	return AlertOK
+}
+
+var alertSeverity = map[string]int{AlertOK: 0, AlertWarn: 1, AlertCrit: 2}
+
+func (self *Alerter) Evaluate(metrics []*Metric) {
+	self.evaluate(metrics, time.Now())
+}
+
+func (self *Alerter) evaluate(metrics []*Metric, now time.Time) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, rule := range self.Rules {
+		for _, metric := range metrics {
+			if !rule.Metric.MatchString(metric.Name) {
+				continue
+			}
+			for _, point := range metric.Points {
+				field, ok := point.Fields[rule.Field]
+				if !ok {
+					continue
+				}
+				value, ok := field.Float()
+				if !ok {
+					continue
+				}
+				key := rule.Name + "|" + point.SeriesKey(metric.Name)
+				state, ok := self.states[key]
+				if !ok {
+					tags := make(map[string]string)
+					for k, v := range point.Tags {
+						tags[k] = v
+					}
+					state = &AlertState{Rule: rule.Name, Metric: metric.Name, Tags: tags, State: AlertOK, Since: now}
+					self.states[key] = state
+				}
+				state.Value = value
+				state.LastValue = now
+				self.update(rule, state, rule.level(value), now)
+			}
+		}
+	}
+
+	if self.StaleAfter > 0 && now.Sub(self.lastSweep) > self.StaleAfter/2 {
+		for key, state := range self.states {
+			if now.Sub(state.LastValue) > self.StaleAfter {
+				delete(self.states, key)
+			}
+		}
+		self.lastSweep = now
+	}
+}
+
+// Must be called with the lock held.
+func (self *Alerter) update(rule *AlertRule, state *AlertState, level string, now time.Time) {
+	if level == state.State {
+		state.pending = ""
+		return
+	}
+	if alertSeverity[level] > alertSeverity[state.State] {
+		if level != state.pending {
+			state.pending = level
+			state.pendingSince = now
+		}
+		if now.Sub(state.pendingSince) < rule.duration {
+			return
+		}
+	}
+
+	notification := &AlertNotification{
+		Rule:      rule.Name,
+		Metric:    state.Metric,
+		Tags:      state.Tags,
+		From:      state.State,
+		To:        level,
+		Value:     state.Value,
+		Timestamp: now.Unix(),
+		Message: fmt.Sprintf("%s: %s.%s %s on %s (value %v)",
+			rule.Name, state.Metric, rule.Field, level, state.Tags["hostname"], state.Value),
+	}
+	log.Println("Alert:", notification.Message)
+	state.State = level
+	state.Since = now
+	state.pending = ""
+	for _, url := range self.Webhooks {
+		go notify(url, notification)
+	}
+}
+
+// A webhook that hangs must not leave a goroutine behind for every state
+// change.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func notify(url string, notification *AlertNotification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		log.Println("Failed to send alert notification:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Alert webhook %s returned %s\n", url, resp.Status)
+	}
+}
+
+func (self *Alerter) States() []*AlertState {
+	self.Lock()
+	defer self.Unlock()
+
+	keys := make([]string, 0, len(self.states))
+	for key := range self.states {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	states := make([]*AlertState, len(keys))
+	for i, key := range keys {
+		state := *self.states[key]
+		states[i] = &state
+	}
+	return states
+}
+
+func evaluateAlerts(metrics []*Metric) {
+	if alerter != nil {
+		alerter.Evaluate(metrics)
+	}
+}
+
+func handleAlerts(w http.ResponseWriter, req *http.Request) {
+	_, handled := handleApiKey(w, req)
+	if handled {
+		return
+	}
+	if alerter == nil {
+		writeJSON(w, []*AlertState{})
+		return
+	}
+	writeJSON(w, alerter.States())
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newAlertReceiver(t *testing.T) (*httptest.Server, chan *AlertNotification) {
+	notifications := make(chan *AlertNotification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		notification := &AlertNotification{}
+		err := json.NewDecoder(req.Body).Decode(notification)
+		if err != nil {
+			t.Error(err)
+		}
+		notifications <- notification
+		w.WriteHeader(204)
+	}))
+	return server, notifications
+}
+
+func expectNotification(t *testing.T, notifications chan *AlertNotification, from, to string) {
+	t.Helper()
+	select {
+	case notification := <-notifications:
+		if notification.From != from || notification.To != to {
+			t.Errorf("got %s -> %s notification, want %s -> %s", notification.From, notification.To, from, to)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s -> %s notification", from, to)
+	}
+}
+
+func expectNoNotification(t *testing.T, notifications chan *AlertNotification) {
+	t.Helper()
+	select {
+	case notification := <-notifications:
+		t.Errorf("unexpected %s -> %s notification", notification.From, notification.To)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func cpuMetrics(host string, user float64) []*Metric {
+	metric := NewMetric("system.cpu")
+	point := NewPoint(0, host)
+	point.SetField("user", user)
+	metric.Add(point)
+	return []*Metric{metric}
+}
+
+func newCPUAlerter(t *testing.T, webhook string, duration time.Duration) *Alerter {
+	pattern, err := CompilePattern("system.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warn, crit := 80.0, 90.0
+	rule := &AlertRule{Name: "cpu", Metric: pattern, Field: "user", Op: ">", Warn: &warn, Crit: &crit, duration: duration}
+	return NewAlerter([]*AlertRule{rule}, []string{webhook}, time.Hour)
+}
+
+func TestAlertFiresAndResolves(t *testing.T) {
+	server, notifications := newAlertReceiver(t)
+	defer server.Close()
+	alerter := newCPUAlerter(t, server.URL, 0)
+	now := time.Now()
+
+	alerter.evaluate(cpuMetrics("web-01", 50), now)
+	expectNoNotification(t, notifications)
+
+	alerter.evaluate(cpuMetrics("web-01", 95), now.Add(time.Minute))
+	expectNotification(t, notifications, AlertOK, AlertCrit)
+
+	alerter.evaluate(cpuMetrics("web-01", 85), now.Add(2*time.Minute))
+	expectNotification(t, notifications, AlertCrit, AlertWarn)
+
+	alerter.evaluate(cpuMetrics("web-01", 10), now.Add(3*time.Minute))
+	expectNotification(t, notifications, AlertWarn, AlertOK)
+
+	states := alerter.States()
+	if len(states) != 1 || states[0].State != AlertOK || states[0].Value != 10 {
+		t.Errorf("unexpected states: %+v", states)
+	}
+}
+
+func TestAlertWaitsForDuration(t *testing.T) {
+	server, notifications := newAlertReceiver(t)
+	defer server.Close()
+	alerter := newCPUAlerter(t, server.URL, 5*time.Minute)
+	now := time.Now()
+
+	alerter.evaluate(cpuMetrics("web-01", 95), now)
+	alerter.evaluate(cpuMetrics("web-01", 95), now.Add(4*time.Minute))
+	expectNoNotification(t, notifications)
+
+	alerter.evaluate(cpuMetrics("web-01", 95), now.Add(5*time.Minute))
+	expectNotification(t, notifications, AlertOK, AlertCrit)
+
+	// Recovering doesn't wait.
+	alerter.evaluate(cpuMetrics("web-01", 10), now.Add(6*time.Minute))
+	expectNotification(t, notifications, AlertCrit, AlertOK)
+
+	// A breach that clears before the duration never fires.
+	alerter.evaluate(cpuMetrics("web-01", 95), now.Add(7*time.Minute))
+	alerter.evaluate(cpuMetrics("web-01", 10), now.Add(8*time.Minute))
+	alerter.evaluate(cpuMetrics("web-01", 95), now.Add(9*time.Minute))
+	alerter.evaluate(cpuMetrics("web-01", 95), now.Add(13*time.Minute))
+	expectNoNotification(t, notifications)
+}
+
+func TestAlertForgetsStaleSeries(t *testing.T) {
+	server, notifications := newAlertReceiver(t)
+	defer server.Close()
+	alerter := newCPUAlerter(t, server.URL, 0)
+	now := time.Now()
+
+	alerter.evaluate(cpuMetrics("web-01", 50), now)
+	alerter.evaluate(cpuMetrics("web-02", 50), now.Add(30*time.Minute))
+	alerter.evaluate(cpuMetrics("web-02", 50), now.Add(61*time.Minute))
+	expectNoNotification(t, notifications)
+
+	states := alerter.States()
+	if len(states) != 1 || states[0].Tags["hostname"] != "web-02" {
+		t.Errorf("unexpected states: %+v", states)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CaptureRecord is one captured request. Body is the decompressed payload, so
+// the Content-Encoding header no longer applies to it.
+type CaptureRecord struct {
+	Time    time.Time         `json:"time"`
+	Path    string            `json:"path"`
+	Host    string            `json:"host"`
+	Query   string            `json:"query"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// Capture writes a sample of the payloads from hosts matching Hosts to JSON
+// lines files in Dir. A new file is started once the current one reaches
+// MaxSize bytes, and only the newest MaxFiles files are kept.
+type Capture struct {
+	sync.Mutex
+	Dir      string
+	Hosts    []*Pattern
+	Sample   float64
+	MaxSize  int64
+	MaxFiles int
+
+	file *os.File
+	size int64
+}
+
+var capture *Capture
+
+func NewCapture(dir, hosts string) (*Capture, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	patterns, err := CompilePatterns(hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{Dir: dir, Hosts: patterns, Sample: 1, MaxSize: 64 << 20, MaxFiles: 10}, nil
+}
+
+func (self *Capture) wants(host string) bool {
+	if self.Sample < 1 && rand.Float64() >= self.Sample {
+		return false
+	}
+	return matchesAny(self.Hosts, host)
+}
+
+func captureFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "capture-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Must be called with the lock held.
+func (self *Capture) rotate() error {
+	if self.file != nil {
+		self.file.Close()
+		self.file = nil
+	}
+	name := "capture-" + time.Now().UTC().Format("20060102T150405.000000000") + ".jsonl"
+	file, err := os.OpenFile(filepath.Join(self.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	self.file = file
+	self.size = 0
+
+	files, err := captureFiles(self.Dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > self.MaxFiles && self.MaxFiles > 0 {
+		err = os.Remove(files[0])
+		if err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+func (self *Capture) Write(record *CaptureRecord) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	self.Lock()
+	defer self.Unlock()
+	if self.file == nil || self.size+int64(len(buf)) > self.MaxSize {
+		err = self.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := self.file.Write(buf)
+	self.size += int64(n)
+	return err
+}
+
+// Headers that carry credentials. API keys are masked the way they are in
+// logs; the others are left out of captures entirely.
+var (
+	captureMaskedHeaders = map[string]bool{
+		"Dd-Api-Key":         true,
+		"Dd-Application-Key": true,
+		"X-Api-Key":          true,
+	}
+	captureDroppedHeaders = map[string]bool{
+		"Authorization":       true,
+		"Proxy-Authorization": true,
+		"Cookie":              true,
+	}
+)
+
+func capturePayload(req *http.Request, host string, body []byte, received time.Time) {
+	if capture == nil || !capture.wants(host) {
+		return
+	}
+	query := req.URL.Query()
+	if key := query.Get("api_key"); len(key) > 0 {
+		query.Set("api_key", maskApiKey(key))
+	}
+	headers := make(map[string]string)
+	for k := range req.Header {
+		k = http.CanonicalHeaderKey(k)
+		if captureDroppedHeaders[k] {
+			continue
+		}
+		headers[k] = req.Header.Get(k)
+		if captureMaskedHeaders[k] {
+			headers[k] = maskApiKey(headers[k])
+		}
+	}
+	record := &CaptureRecord{received, req.URL.Path, host, query.Encode(), headers, body}
+	err := capture.Write(record)
+	if err != nil {
+		log.Println("Failed to capture payload:", err)
+	}
+}
+
+func replayRecord(record *CaptureRecord, sink Sink) error {
+	metrics, err := payloadMetrics(record.Path, record.Body, record.Time)
+	if err != nil {
+		return err
+	}
+	sink.Push(metrics)
+	return nil
+}
+
+func replayFile(path string, hosts []*Pattern, sink Sink) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			record := &CaptureRecord{}
+			if err := json.Unmarshal(line, record); err != nil {
+				log.Printf("Skipping bad capture record in %s: %v\n", path, err)
+			} else if matchesAny(hosts, record.Host) {
+				if err := replayRecord(record, sink); err != nil {
+					log.Printf("Failed to replay %s payload from %s: %v\n", record.Path, record.Host, err)
+				} else {
+					count++
+				}
+			}
+		}
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+	}
+}
+
+func matchesAny(patterns []*Pattern, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// replay implements "dd-house replay [flags] file|dir...", which feeds
+// captured payloads through the pipeline configured in the environment.
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	db := flags.String("db", "", "write to this database instead of the one in DB_URL")
+	stdout := flags.Bool("stdout", false, "print InfluxDB 0.8 JSON instead of writing to InfluxDB")
+	hosts := flags.String("hosts", "", "only replay payloads from hosts matching these comma separated patterns")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dd-house replay [flags] file|dir...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	hostPatterns, err := CompilePatterns(*hosts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var sink Sink
+	if *stdout {
+		disableQuarantine()
+		sink = &WriterSink{os.Stdout, "json", mainSink.Precision}
+	} else {
+		if len(*db) > 0 {
+			dbName = *db
+			mainSink = &InfluxSink{dbName, mainSink.Precision}
+		}
+		createDatabases()
+		sink = mainSink
+	}
+
+	paths := []string{}
+	for _, arg := range flags.Args() {
+		info, err := os.Stat(arg)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		files, err := captureFiles(arg)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		paths = append(paths, files...)
+	}
+
+	total := 0
+	for _, path := range paths {
+		count, err := replayFile(path, hostPatterns, sink)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		total += count
+	}
+	waitForQuarantine()
+	log.Printf("Replayed %d payloads from %d files\n", total, len(paths))
+}
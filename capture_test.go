@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureMasksCredentials(t *testing.T) {
+	defer func(c *Capture) { capture = c }(capture)
+	var err error
+	capture, err = NewCapture(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/intake/?api_key=0123456789abcdef", strings.NewReader("{}"))
+	req.Header.Set("DD-API-KEY", "0123456789abcdef")
+	req.Header.Set("X-Api-Key", "fedcba9876543210")
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Content-Type", "application/json")
+	capturePayload(req, "web-01", []byte("{}"), time.Now())
+	capture.file.Close()
+
+	files, err := captureFiles(capture.Dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got capture files %v, %v", files, err)
+	}
+	buf, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"0123456789abcdef", "fedcba9876543210", "secret-token", "session=secret"} {
+		if strings.Contains(string(buf), secret) {
+			t.Errorf("capture contains %q: %s", secret, buf)
+		}
+	}
+
+	record := &CaptureRecord{}
+	err = json.Unmarshal(buf, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Headers["Dd-Api-Key"] != "0123..." {
+		t.Errorf("api key header is %q, want it masked", record.Headers["Dd-Api-Key"])
+	}
+	if record.Headers["Content-Type"] != "application/json" {
+		t.Errorf("other headers were not kept: %v", record.Headers)
+	}
+}
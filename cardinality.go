@@ -0,0 +1,129 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+)
+
+// CardinalityGuard limits the number of distinct tag keys per metric and the
+// number of distinct values per tag key. Values past the limit are dropped,
+// replaced by a hash, or folded into a fixed number of buckets.
+// Values are only tracked when MaxValues is set.
+type CardinalityGuard struct {
+	sync.Mutex
+	MaxKeys   int
+	MaxValues int
+	Action    string
+	Buckets   int
+
+	series map[string]map[string]map[string]bool
+}
+
+var (
+	cardinalityGuard *CardinalityGuard
+	cardinalityVars  = expvar.NewMap("cardinality_limited")
+)
+
+func NewCardinalityGuard(maxKeys, maxValues int, action string, buckets int) (*CardinalityGuard, error) {
+	switch action {
+	case "", "drop":
+		action = "drop"
+	case "hash", "bucket":
+	default:
+		return nil, fmt.Errorf("unknown cardinality action: %q", action)
+	}
+	if buckets <= 0 {
+		buckets = 16
+	}
+	return &CardinalityGuard{
+		MaxKeys:   maxKeys,
+		MaxValues: maxValues,
+		Action:    action,
+		Buckets:   buckets,
+		series:    make(map[string]map[string]map[string]bool),
+	}, nil
+}
+
+func (self *CardinalityGuard) trip(metric, key, reason string) {
+	name := metric + "/" + key
+	if cardinalityVars.Get(name) == nil {
+		log.Printf("Cardinality limit on %s: %s\n", name, reason)
+	}
+	cardinalityVars.Add(name, 1)
+}
+
+// Check returns the value to store for the tag key on metric, or false if the
+// tag should be dropped. With preview set, new keys and values are not
+// recorded.
+func (self *CardinalityGuard) Check(metric, key, value string, preview bool) (string, bool) {
+	self.Lock()
+	defer self.Unlock()
+
+	keys, ok := self.series[metric]
+	if !ok {
+		keys = make(map[string]map[string]bool)
+		if !preview {
+			self.series[metric] = keys
+		}
+	}
+	values, ok := keys[key]
+	if !ok {
+		if self.MaxKeys > 0 && len(keys) >= self.MaxKeys {
+			if !preview {
+				self.trip(metric, key, fmt.Sprintf("more than %d tag keys", self.MaxKeys))
+			}
+			return "", false
+		}
+		values = make(map[string]bool)
+		if !preview {
+			keys[key] = values
+		}
+	}
+
+	if self.MaxValues == 0 {
+		return value, true
+	}
+	if values[value] {
+		return value, true
+	}
+	if len(values) < self.MaxValues {
+		if !preview {
+			values[value] = true
+		}
+		return value, true
+	}
+
+	if !preview {
+		self.trip(metric, key, fmt.Sprintf("more than %d values", self.MaxValues))
+	}
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	switch self.Action {
+	case "hash":
+		return fmt.Sprintf("%08x", h.Sum32()), true
+	case "bucket":
+		return fmt.Sprintf("bucket-%d", h.Sum32()%uint32(self.Buckets)), true
+	}
+	return "", false
+}
+
+func guardTag(metric, key, value string, preview bool) (string, bool) {
+	if cardinalityGuard == nil {
+		return value, true
+	}
+	return cardinalityGuard.Check(metric, key, value, preview)
+}
+
+func guardTags(metric string, tags map[string]interface{}, preview bool) {
+	for k, v := range tags {
+		value, ok := guardTag(metric, k, tagString(v), preview)
+		if ok {
+			tags[k] = value
+		} else {
+			delete(tags, k)
+		}
+	}
+}
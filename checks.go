@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var serviceCheckStatuses = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+func serviceCheckStatusName(status int) string {
+	if status >= 0 && status < len(serviceCheckStatuses) {
+		return serviceCheckStatuses[status]
+	}
+	return fmt.Sprint(status)
+}
+
+type ServiceCheckState struct {
+	Host    string    `json:"host"`
+	Check   string    `json:"check"`
+	Tags    []string  `json:"tags"`
+	Status  int       `json:"status"`
+	Name    string    `json:"status_name"`
+	Message string    `json:"message"`
+	Since   time.Time `json:"since"`
+	Last    time.Time `json:"last"`
+}
+
+// ServiceCheckTracker keeps the current status of every host, check and tag
+// set, and reports a state change event whenever the status changes.
+type ServiceCheckTracker struct {
+	sync.Mutex
+	states map[string]*ServiceCheckState
+}
+
+var serviceChecks = &ServiceCheckTracker{states: make(map[string]*ServiceCheckState)}
+
+// Update records a check result and returns a status change point, or nil if
+// the status is unchanged.
+func (self *ServiceCheckTracker) Update(host, check string, tags []string, status int, message string, timestamp float64) *Point {
+	point, event := self.update(host, check, tags, status, message, timestamp)
+	// Sending may block, so it must happen without the lock held.
+	if event != nil {
+		emitEvent(event)
+	}
+	return point
+}
+
+func (self *ServiceCheckTracker) update(host, check string, tags []string, status int, message string, timestamp float64) (*Point, map[string]interface{}) {
+	self.Lock()
+	defer self.Unlock()
+
+	tags = append([]string{}, tags...)
+	sort.Strings(tags)
+	key := host + "|" + check + "|" + strings.Join(tags, ",")
+	now := time.Unix(0, int64(timestamp*float64(time.Second)))
+
+	state, ok := self.states[key]
+	if !ok {
+		self.states[key] = &ServiceCheckState{host, check, tags, status, serviceCheckStatusName(status), message, now, now}
+		return nil, nil
+	}
+	if now.Before(state.Last) {
+		return nil, nil
+	}
+	state.Last = now
+	state.Message = message
+	if state.Status == status {
+		return nil, nil
+	}
+
+	oldName, newName := state.Name, serviceCheckStatusName(status)
+	duration := now.Sub(state.Since)
+	alertType := "error"
+	if status == 0 {
+		alertType = "success"
+	}
+	event := map[string]interface{}{
+		"msg_title":  fmt.Sprintf("%s on %s is %s", check, host, newName),
+		"msg_text":   fmt.Sprintf("%s changed from %s to %s after %v: %s", check, oldName, newName, duration, message),
+		"timestamp":  now.Unix(),
+		"host":       host,
+		"tags":       tags,
+		"alert_type": alertType,
+		"event_type": "service_check.status_change",
+		"source":     "dd-house",
+	}
+
+	point := NewPoint(agentTimestamp(timestamp), host)
+	point.SetTag("check", check)
+	point.SetTag("tags", strings.Join(tags, ","))
+	point.SetField("old_status", state.Status)
+	point.SetField("status", status)
+	point.SetField("old_status_name", oldName)
+	point.SetField("status_name", newName)
+	point.SetField("message", message)
+	point.SetField("duration", duration.Seconds())
+	state.Status = status
+	state.Name = newName
+	state.Since = now
+	return point, event
+}
+
+func (self *ServiceCheckTracker) States() []*ServiceCheckState {
+	self.Lock()
+	defer self.Unlock()
+
+	keys := make([]string, 0, len(self.states))
+	for key := range self.states {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	states := make([]*ServiceCheckState, len(keys))
+	for i, key := range keys {
+		state := *self.states[key]
+		states[i] = &state
+	}
+	return states
+}
+
+func handleChecks(w http.ResponseWriter, req *http.Request) {
+	_, handled := handleApiKey(w, req)
+	if handled {
+		return
+	}
+	writeJSON(w, serviceChecks.States())
+}
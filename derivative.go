@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+type counterState struct {
+	value     float64
+	timestamp uint64
+	seen      time.Time
+}
+
+// Derivative turns cumulative counters into per second rates. It keeps the
+// last value of every host, series and tag set, and forgets series that
+// haven't reported within TTL.
+type Derivative struct {
+	sync.Mutex
+	Patterns []*Pattern
+	TTL      time.Duration
+
+	counters  map[string]*counterState
+	lastSweep time.Time
+}
+
+var derivative *Derivative
+
+func NewDerivative(patterns string, ttl time.Duration) (*Derivative, error) {
+	self := &Derivative{TTL: ttl, counters: make(map[string]*counterState), lastSweep: time.Now()}
+	for _, str := range strings.Split(patterns, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+		pattern, err := CompilePattern(str)
+		if err != nil {
+			return nil, err
+		}
+		self.Patterns = append(self.Patterns, pattern)
+	}
+	return self, nil
+}
+
+func (self *Derivative) isCumulative(name string) bool {
+	for _, pattern := range self.Patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the rate since the last value of the series, or false for the first
+// value and after a counter reset. The value is only stored if record is set.
+func (self *Derivative) rate(key string, value float64, timestamp uint64, now time.Time, record bool) (float64, bool) {
+	last, ok := self.counters[key]
+	if !ok {
+		if record {
+			self.counters[key] = &counterState{value, timestamp, now}
+		}
+		return 0, false
+	}
+	if timestamp <= last.timestamp {
+		return 0, false
+	}
+
+	delta := value - last.value
+	if delta < 0 {
+		switch {
+		case last.value <= math.MaxUint32 && last.value > math.MaxUint32*0.75:
+			delta = math.MaxUint32 - last.value + value + 1
+		case last.value > math.MaxUint64*0.75:
+			delta = math.MaxUint64 - last.value + value + 1
+		default:
+			delta = -1
+		}
+	}
+	seconds := float64(timestamp-last.timestamp) / float64(time.Second)
+	if record {
+		*last = counterState{value, timestamp, now}
+	}
+	if delta < 0 {
+		return 0, false
+	}
+	return delta / seconds, true
+}
+
+// Apply replaces cumulative fields with their rates. Points left without
+// fields, for the first value of a series or after a reset, are dropped. A
+// preview computes the rates without storing the new values.
+func (self *Derivative) Apply(metrics []*Metric, preview bool) []*Metric {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now()
+	result := metrics[:0]
+	for _, metric := range metrics {
+		points := metric.Points[:0]
+		for _, point := range metric.Points {
+			removed := false
+			for field, value := range point.Fields {
+				name := metric.Name
+				if field != "value" {
+					name += "." + field
+				}
+				if !self.isCumulative(name) {
+					continue
+				}
+				v, ok := value.Float()
+				if !ok {
+					continue
+				}
+				rate, ok := self.rate(point.SeriesKey(name), v, point.Time, now, !preview)
+				if ok {
+					point.Fields[field] = FloatValue(rate)
+				} else {
+					delete(point.Fields, field)
+					removed = true
+				}
+			}
+			if !removed || len(point.Fields) > 0 {
+				points = append(points, point)
+			}
+		}
+		metric.Points = points
+		if len(points) > 0 {
+			result = append(result, metric)
+		}
+	}
+
+	if !preview && now.Sub(self.lastSweep) > self.TTL/2 {
+		for key, counter := range self.counters {
+			if now.Sub(counter.seen) > self.TTL {
+				delete(self.counters, key)
+			}
+		}
+		self.lastSweep = now
+	}
+	return result
+}
+
+func deriveMetrics(metrics []*Metric, preview bool) []*Metric {
+	if derivative == nil {
+		return metrics
+	}
+	return derivative.Apply(metrics, preview)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func netMetrics(timestamp uint64, bytes float64) []*Metric {
+	metric := NewMetric("system.net")
+	point := NewPoint(timestamp, "web-01")
+	point.SetTag("device", "eth0")
+	point.SetField("bytes_rcvd", bytes)
+	metric.Add(point)
+	return []*Metric{metric}
+}
+
+func TestDerivativeDropsPointsWithoutRates(t *testing.T) {
+	counters, err := NewDerivative("system.net.bytes_rcvd", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := uint64(1560000000 * time.Second)
+
+	if metrics := counters.Apply(netMetrics(start, 1000), false); len(metrics) != 0 {
+		t.Errorf("first value wrote %d metrics, want none", len(metrics))
+	}
+	metrics := counters.Apply(netMetrics(start+uint64(10*time.Second), 2000), false)
+	if len(metrics) != 1 || metrics[0].Points[0].Fields["bytes_rcvd"].f != 100 {
+		t.Errorf("unexpected rate: %+v", metrics)
+	}
+	if metrics := counters.Apply(netMetrics(start+uint64(20*time.Second), 10), false); len(metrics) != 0 {
+		t.Errorf("counter reset wrote %d metrics, want none", len(metrics))
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DiskLayout maps the positional columns of a diskUsage or inodes row to
+// column names. Layouts are told apart by their column count, and by whether
+// the second column is numeric.
+type DiskLayout struct {
+	Name    string
+	Columns []string
+	FsType  bool
+}
+
+var diskLayouts = []*DiskLayout{
+	// df -k on Linux and the BSDs
+	{"posix", []string{"device", "total", "used", "free", "in_use", "mount"}, false},
+	// df -kT, which adds the filesystem type after the device
+	{"posix_fstype", []string{"device", "fs_type", "total", "used", "free", "in_use", "mount"}, true},
+	// df -ki on OS X, which adds inode columns before the mount
+	{"darwin", []string{"device", "total", "used", "free", "in_use", "inodes_used", "inodes_free", "inodes_in_use", "mount"}, false},
+}
+
+var diskNumericColumns = map[string]bool{
+	"total":       true,
+	"used":        true,
+	"free":        true,
+	"inodes_used": true,
+	"inodes_free": true,
+}
+
+var diskTagColumns = map[string]bool{
+	"device":  true,
+	"fs_type": true,
+	"mount":   true,
+}
+
+var diskPercentColumns = map[string]bool{
+	"in_use":        true,
+	"inodes_in_use": true,
+}
+
+func isNumeric(value interface{}) bool {
+	switch v := value.(type) {
+	case float64:
+		return true
+	case string:
+		_, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+		return err == nil
+	}
+	return false
+}
+
+func detectDiskLayout(fields []interface{}) *DiskLayout {
+	for _, layout := range diskLayouts {
+		if len(layout.Columns) != len(fields) {
+			continue
+		}
+		if layout.FsType == isNumeric(fields[1]) {
+			continue
+		}
+		return layout
+	}
+	return nil
+}
+
+func parseNumber(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case string:
+		parse, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err == nil {
+			return parse
+		}
+	}
+	return nil
+}
+
+// The in_use columns of every layout are percentages, whether or not the
+// agent kept the % sign, and become a fraction of 1.
+func parsePercent(value interface{}) interface{} {
+	if str, ok := value.(string); ok {
+		value = strings.TrimSuffix(strings.TrimSpace(str), "%")
+	}
+	parse := parseNumber(value)
+	if parse == nil {
+		return nil
+	}
+	return parse.(float64) / 100.0
+}
+
+// Returns the value of the first of keys that is present.
+func ioValue(fields map[string]interface{}, keys []string) interface{} {
+	for _, key := range keys {
+		if value, ok := fields[key]; ok {
+			return parseNumber(value)
+		}
+	}
+	return nil
+}
+
+// Newer versions of iostat replace avgrq-sz, in sectors, with separate read
+// and write request sizes in kB. Their average, weighted by the read and
+// write rates, gives back the old column.
+func averageRequestSize(fields map[string]interface{}) interface{} {
+	var size, requests float64
+	for _, keys := range [][]string{{"r/s", "rareq-sz"}, {"w/s", "wareq-sz"}} {
+		rate, ok := parseNumber(fields[keys[0]]).(float64)
+		if !ok {
+			return nil
+		}
+		kb, ok := parseNumber(fields[keys[1]]).(float64)
+		if !ok {
+			return nil
+		}
+		size += rate * kb
+		requests += rate
+	}
+	if requests == 0 {
+		return 0.0
+	}
+	return size / requests * 2
+}
+
+// Converts an ioStats key that has no entry in ioMetricMapping into a column
+// name, e.g. "system.io.bytes_per_s" or "kB/t".
+func ioColumnName(key string) string {
+	key = strings.TrimPrefix(key, "system.io.")
+	key = strings.Replace(key, "%", "pct_", -1)
+	key = strings.Replace(key, "/", "_", -1)
+	key = strings.Replace(key, "-", "_", -1)
+	return strings.ToLower(key)
+}
+
+// Finds the ioStats keys that have no canonical column. Their column names are
+// prefixed with "raw_" when they would clash with a canonical column or with
+// another key that sorts before them.
+func extraIOColumns(data map[string]interface{}) ([]string, map[string]string) {
+	taken := make(map[string]bool)
+	known := make(map[string]bool)
+	for column, keys := range ioMetricMapping {
+		taken[column] = true
+		for _, key := range keys {
+			known[key] = true
+		}
+	}
+	unknown := make(map[string]bool)
+	for _, disk := range data {
+		fields, ok := disk.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key := range fields {
+			if !known[key] {
+				unknown[key] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(unknown))
+	for key := range unknown {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	extra := make(map[string]string)
+	for _, key := range keys {
+		column := ioColumnName(key)
+		for taken[column] {
+			column = "raw_" + column
+		}
+		taken[column] = true
+		extra[column] = key
+	}
+	columns := make([]string, 0, len(extra))
+	for column := range extra {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns, extra
+}
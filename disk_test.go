@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParsePercent(t *testing.T) {
+	for _, test := range []struct {
+		value interface{}
+		want  interface{}
+	}{
+		{"45%", 0.45},
+		{" 0.5% ", 0.005},
+		{"0.5", 0.005},
+		{1.0, 0.01},
+		{"-", nil},
+	} {
+		if got := parsePercent(test.value); got != test.want {
+			t.Errorf("parsePercent(%#v) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestExtraIOColumnsAvoidCanonicalNames(t *testing.T) {
+	data := map[string]interface{}{
+		"sda": map[string]interface{}{
+			"%util":          "1.00",
+			"util":           "2.00",
+			"system.io.r_s":  3.0,
+			"aqu-sz":         "0.10",
+			"kB/t":           "4.00",
+			"system.io.tps":  5.0,
+			"avgqu-sz":       "0.20",
+			"system.io.util": 6.0,
+		},
+	}
+	columns, keys := extraIOColumns(data)
+	want := map[string]string{
+		"kb_t":         "kB/t",
+		"raw_r_s":      "system.io.r_s",
+		"raw_util":     "system.io.util",
+		"raw_raw_util": "util",
+		"tps":          "system.io.tps",
+	}
+	if len(columns) != len(want) {
+		t.Fatalf("got columns %v, want %v", columns, want)
+	}
+	for column, key := range want {
+		if keys[column] != key {
+			t.Errorf("column %s maps to %q, want %q", column, keys[column], key)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// DiskFilter selects which rows of system.disk, system.fs.inodes and
+// system.io are kept. Exclude patterns win over include patterns.
+type DiskFilter struct {
+	DeviceInclude *regexp.Regexp
+	DeviceExclude *regexp.Regexp
+	MountInclude  *regexp.Regexp
+	MountExclude  *regexp.Regexp
+	FsTypeInclude *regexp.Regexp
+	FsTypeExclude *regexp.Regexp
+	Dedupe        bool
+}
+
+var diskFilter = &DiskFilter{}
+
+func compileEnvRegexp(name string) (*regexp.Regexp, error) {
+	expr := os.Getenv(name)
+	if len(expr) == 0 {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+func LoadDiskFilter() (*DiskFilter, error) {
+	self := &DiskFilter{}
+	patterns := []struct {
+		env  string
+		dest **regexp.Regexp
+	}{
+		{"DISK_DEVICE_INCLUDE", &self.DeviceInclude},
+		{"DISK_DEVICE_EXCLUDE", &self.DeviceExclude},
+		{"DISK_MOUNT_INCLUDE", &self.MountInclude},
+		{"DISK_MOUNT_EXCLUDE", &self.MountExclude},
+		{"DISK_FSTYPE_INCLUDE", &self.FsTypeInclude},
+		{"DISK_FSTYPE_EXCLUDE", &self.FsTypeExclude},
+	}
+	for _, pattern := range patterns {
+		re, err := compileEnvRegexp(pattern.env)
+		if err != nil {
+			return nil, err
+		}
+		*pattern.dest = re
+	}
+	dedupe := strings.ToLower(os.Getenv("DISK_DEDUPE"))
+	self.Dedupe = dedupe == "1" || dedupe == "true" || dedupe == "yes"
+	return self, nil
+}
+
+func matchFilter(include, exclude *regexp.Regexp, value string) bool {
+	if include != nil && !include.MatchString(value) {
+		return false
+	}
+	if exclude != nil && exclude.MatchString(value) {
+		return false
+	}
+	return true
+}
+
+func (self *DiskFilter) KeepDevice(device string) bool {
+	return matchFilter(self.DeviceInclude, self.DeviceExclude, device)
+}
+
+// Rows without a filesystem type column are matched on the device name, which
+// df reports as the filesystem type for tmpfs, overlay and the like.
+func (self *DiskFilter) KeepRow(row map[string]interface{}) bool {
+	device, _ := row["device"].(string)
+	mount, _ := row["mount"].(string)
+	fsType, ok := row["fs_type"].(string)
+	if !ok {
+		fsType = device
+	}
+	return self.KeepDevice(device) &&
+		matchFilter(self.MountInclude, self.MountExclude, mount) &&
+		matchFilter(self.FsTypeInclude, self.FsTypeExclude, fsType)
+}
+
+// Bind mounts show up as the same block device mounted more than once. Only
+// the row with the shortest mount point is kept for each device.
+func (self *DiskFilter) DedupeRows(rows []map[string]interface{}) []map[string]interface{} {
+	if !self.Dedupe {
+		return rows
+	}
+	best := make(map[string]int)
+	for i, row := range rows {
+		device, _ := row["device"].(string)
+		if !strings.HasPrefix(device, "/") {
+			continue
+		}
+		mount, _ := row["mount"].(string)
+		j, ok := best[device]
+		if !ok {
+			best[device] = i
+			continue
+		}
+		other, _ := rows[j]["mount"].(string)
+		if len(mount) < len(other) {
+			best[device] = i
+		}
+	}
+
+	result := rows[:0]
+	for i, row := range rows {
+		device, _ := row["device"].(string)
+		if j, ok := best[device]; ok && j != i {
+			continue
+		}
+		result = append(result, row)
+	}
+	return result
+}
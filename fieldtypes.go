@@ -0,0 +1,291 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FieldTypeRule declares the type of fields on metrics matching Metric, e.g.
+// {"metric": "system.disk", "fields": {"total": "float"}}.
+type FieldTypeRule struct {
+	Metric *Pattern          `json:"metric"`
+	Fields map[string]string `json:"fields"`
+
+	types map[string]ValueType
+}
+
+// FieldTypes keeps the type of every metric and field, either declared by a
+// rule or learned from the first value seen. Values of another type are
+// coerced if that loses nothing; otherwise the field is removed from the
+// point, and written to the Quarantine sink renamed after its type. Learned
+// types of metrics that haven't been seen within TTL are forgotten.
+type FieldTypes struct {
+	sync.Mutex
+	Rules      []*FieldTypeRule
+	Action     string
+	Quarantine *InfluxSink
+	TTL        time.Duration
+
+	learned   map[string]*learnedTypes
+	lastSweep time.Time
+	pending   sync.WaitGroup
+}
+
+type learnedTypes struct {
+	types map[string]ValueType
+	seen  time.Time
+}
+
+var (
+	fieldTypes        *FieldTypes
+	fieldConflictVars = expvar.NewMap("field_type_conflicts")
+)
+
+func parseValueType(name string) (ValueType, error) {
+	for t, typeName := range valueTypeNames {
+		if typeName == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown field type: %q", name)
+}
+
+func LoadFieldTypes(path, action string, ttl time.Duration) (*FieldTypes, error) {
+	switch action {
+	case "":
+		action = "drop"
+	case "drop", "quarantine":
+	default:
+		return nil, fmt.Errorf("unknown field conflict action: %q", action)
+	}
+	rules := []*FieldTypeRule{}
+	if len(path) > 0 {
+		err := loadJSONConfig(path, &rules)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range rules {
+		rule.types = make(map[string]ValueType)
+		for field, name := range rule.Fields {
+			t, err := parseValueType(name)
+			if err != nil {
+				return nil, err
+			}
+			rule.types[field] = t
+		}
+	}
+	return &FieldTypes{Rules: rules, Action: action, TTL: ttl, learned: make(map[string]*learnedTypes), lastSweep: time.Now()}, nil
+}
+
+func (self *FieldTypes) declared(name, field string) (ValueType, bool) {
+	for _, rule := range self.Rules {
+		if !rule.Metric.MatchValue(name) {
+			continue
+		}
+		if t, ok := rule.types[field]; ok {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// Must be called with the lock held. Types are only learned if record is set.
+func (self *FieldTypes) fieldType(name, field string, value Value, now time.Time, record bool) ValueType {
+	learned, ok := self.learned[name]
+	if !ok {
+		learned = &learnedTypes{types: make(map[string]ValueType)}
+		if record {
+			self.learned[name] = learned
+		}
+	}
+	if record {
+		learned.seen = now
+	}
+	t, ok := learned.types[field]
+	if !ok {
+		t, ok = self.declared(name, field)
+		if !ok {
+			t = value.Type
+		}
+		if record {
+			learned.types[field] = t
+		}
+	}
+	return t
+}
+
+// Converts value to type t if it can be done without losing information.
+func coerceValue(value Value, t ValueType) (Value, bool) {
+	switch t {
+	case FloatType:
+		if v, ok := value.Float(); ok {
+			return FloatValue(v), true
+		}
+		if value.Type == StringType {
+			v, err := strconv.ParseFloat(strings.TrimSpace(value.s), 64)
+			return FloatValue(v), err == nil
+		}
+	case IntType:
+		if value.Type == FloatType && value.f == float64(int64(value.f)) {
+			return IntValue(int64(value.f)), true
+		}
+		if value.Type == StringType {
+			v, err := strconv.ParseInt(strings.TrimSpace(value.s), 10, 64)
+			return IntValue(v), err == nil
+		}
+	case StringType:
+		return StringValue(value.Str()), true
+	case BoolType:
+		if value.Type == StringType {
+			v, err := strconv.ParseBool(value.s)
+			return BoolValue(v), err == nil
+		}
+	}
+	return Value{}, false
+}
+
+// Enforce coerces or removes conflicting values, keeping the rest of the
+// point. A preview neither learns types nor counts or quarantines conflicts.
+func (self *FieldTypes) Enforce(metrics []*Metric, preview bool) []*Metric {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now()
+	result := metrics[:0]
+	quarantined := []*Metric{}
+	for _, metric := range metrics {
+		held := NewMetric(metric.Name)
+		points := metric.Points[:0]
+		for _, point := range metric.Points {
+			conflicts := make(map[string]Value)
+			for field, value := range point.Fields {
+				t := self.fieldType(metric.Name, field, value, now, !preview)
+				if value.Type == t {
+					continue
+				}
+				if v, ok := coerceValue(value, t); ok {
+					point.Fields[field] = v
+					continue
+				}
+				conflicts[field] = value
+				delete(point.Fields, field)
+				if preview {
+					continue
+				}
+				name := metric.Name + "." + field
+				if fieldConflictVars.Get(name) == nil {
+					log.Printf("Field type conflict on %s: %s value for %s field\n", name, value.Type, t)
+				}
+				fieldConflictVars.Add(name, 1)
+			}
+			if len(conflicts) > 0 && self.Quarantine != nil && !preview {
+				conflicting := &Point{point.Time, point.Tags, make(map[string]Value, len(conflicts))}
+				for field, value := range conflicts {
+					conflicting.Fields[field+"_"+value.Type.String()] = value
+				}
+				held.Add(conflicting.Copy())
+			}
+			if len(point.Fields) > 0 {
+				points = append(points, point)
+			}
+		}
+		metric.Points = points
+		if len(points) > 0 {
+			result = append(result, metric)
+		}
+		if len(held.Points) > 0 {
+			quarantined = append(quarantined, held)
+		}
+	}
+	if len(quarantined) > 0 {
+		self.pending.Add(1)
+		go func() {
+			defer self.pending.Done()
+			self.Quarantine.Push(quarantined)
+		}()
+	}
+
+	if !preview && self.TTL > 0 && now.Sub(self.lastSweep) > self.TTL/2 {
+		for name, learned := range self.learned {
+			if now.Sub(learned.seen) > self.TTL {
+				delete(self.learned, name)
+			}
+		}
+		self.lastSweep = now
+	}
+	return result
+}
+
+type fieldTypeEntry struct {
+	Metric   string `json:"metric"`
+	Field    string `json:"field"`
+	Type     string `json:"type"`
+	Declared bool   `json:"declared"`
+}
+
+func (self *FieldTypes) Types() []*fieldTypeEntry {
+	self.Lock()
+	defer self.Unlock()
+
+	entries := []*fieldTypeEntry{}
+	for name, learned := range self.learned {
+		for field, t := range learned.types {
+			_, declared := self.declared(name, field)
+			entries = append(entries, &fieldTypeEntry{name, field, t.String(), declared})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Metric != entries[j].Metric {
+			return entries[i].Metric < entries[j].Metric
+		}
+		return entries[i].Field < entries[j].Field
+	})
+	return entries
+}
+
+// Wait blocks until the quarantined points have been written, so that the
+// command line tools don't exit in the middle of a push.
+func (self *FieldTypes) Wait() {
+	self.pending.Wait()
+}
+
+// The command line tools that only print must not write to InfluxDB, so
+// conflicting fields are dropped instead of quarantined.
+func disableQuarantine() {
+	if fieldTypes != nil {
+		fieldTypes.Quarantine = nil
+	}
+}
+
+func waitForQuarantine() {
+	if fieldTypes != nil {
+		fieldTypes.Wait()
+	}
+}
+
+func enforceFieldTypes(metrics []*Metric, preview bool) []*Metric {
+	if fieldTypes == nil {
+		return metrics
+	}
+	return fieldTypes.Enforce(metrics, preview)
+}
+
+func handleFieldTypes(w http.ResponseWriter, req *http.Request) {
+	_, handled := handleApiKey(w, req)
+	if handled {
+		return
+	}
+	if fieldTypes == nil {
+		writeJSON(w, []*fieldTypeEntry{})
+		return
+	}
+	writeJSON(w, fieldTypes.Types())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func diskMetric(host string, total interface{}) []*Metric {
+	metric := NewMetric("system.disk")
+	point := NewPoint(0, host)
+	point.SetTag("device", "/dev/sda1")
+	point.SetField("total", total)
+	point.SetField("used", 10.0)
+	metric.Add(point)
+	return []*Metric{metric}
+}
+
+func TestFieldTypesDropOnlyConflictingField(t *testing.T) {
+	types, err := LoadFieldTypes("", "drop", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types.Enforce(diskMetric("web-01", 100.0), false)
+
+	metrics := types.Enforce(diskMetric("web-01", "12"), false)
+	if value := metrics[0].Points[0].Fields["total"]; value.Type != FloatType || value.f != 12 {
+		t.Errorf("numeric string was not coerced: %+v", value)
+	}
+
+	metrics = types.Enforce(diskMetric("web-01", "unknown"), false)
+	if len(metrics) != 1 || len(metrics[0].Points) != 1 {
+		t.Fatalf("conflicting point was dropped: %+v", metrics)
+	}
+	fields := metrics[0].Points[0].Fields
+	if _, ok := fields["total"]; ok {
+		t.Errorf("conflicting field was kept: %+v", fields)
+	}
+	if _, ok := fields["used"]; !ok {
+		t.Errorf("other fields were removed: %+v", fields)
+	}
+}
+
+func TestFieldTypesForgetStaleMetrics(t *testing.T) {
+	types, err := LoadFieldTypes("", "drop", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types.Enforce(diskMetric("web-01", 100.0), false)
+	types.learned["system.disk"].seen = time.Now().Add(-2 * time.Hour)
+	types.lastSweep = time.Now().Add(-time.Hour)
+
+	types.Enforce(cpuMetrics("web-01", 1), false)
+
+	if _, ok := types.learned["system.disk"]; ok {
+		t.Error("stale metric types were kept")
+	}
+	if _, ok := types.learned["system.cpu"]; !ok {
+		t.Error("fresh metric types were forgotten")
+	}
+}
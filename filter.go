@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Pattern matches metric names, hosts and tag values. Patterns wrapped in
+// slashes are regular expressions, anything else is a glob.
+type Pattern struct {
+	*regexp.Regexp
+}
+
+func CompilePattern(pattern string) (*Pattern, error) {
+	var expr string
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		expr = pattern[1 : len(pattern)-1]
+	} else {
+		parts := strings.Split(pattern, "*")
+		for i, part := range parts {
+			parts[i] = strings.Replace(regexp.QuoteMeta(part), `\?`, ".", -1)
+		}
+		expr = "^" + strings.Join(parts, ".*") + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &Pattern{re}, nil
+}
+
+// Compiles a comma separated list of patterns.
+func CompilePatterns(patterns string) ([]*Pattern, error) {
+	result := []*Pattern{}
+	for _, str := range strings.Split(patterns, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+		pattern, err := CompilePattern(str)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, pattern)
+	}
+	return result, nil
+}
+
+func (self *Pattern) UnmarshalJSON(data []byte) error {
+	var str string
+	err := json.Unmarshal(data, &str)
+	if err != nil {
+		return err
+	}
+	pattern, err := CompilePattern(str)
+	if err != nil {
+		return err
+	}
+	*self = *pattern
+	return nil
+}
+
+func (self *Pattern) MatchValue(value interface{}) bool {
+	if self == nil {
+		return true
+	}
+	if str, ok := value.(string); ok {
+		return self.MatchString(str)
+	}
+	return self.MatchString(fmt.Sprint(value))
+}
+
+type FilterRule struct {
+	Action string              `json:"action"`
+	Metric *Pattern            `json:"metric"`
+	Host   *Pattern            `json:"host"`
+	Tags   map[string]*Pattern `json:"tags"`
+	Drop   []string            `json:"drop"`
+}
+
+func (self *FilterRule) matchPoint(point *Point) bool {
+	if self.Host != nil {
+		host, ok := point.Tags["hostname"]
+		if !ok || !self.Host.MatchValue(host) {
+			return false
+		}
+	}
+	for k, pattern := range self.Tags {
+		value, ok := point.Lookup(k)
+		if !ok || !pattern.MatchValue(value) {
+			return false
+		}
+	}
+	return true
+}
+
+var filterRules []*FilterRule
+
+func loadFilterRules(path string) ([]*FilterRule, error) {
+	rules := []*FilterRule{}
+	err := loadJSONConfig(path, &rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		switch rule.Action {
+		case "include", "exclude":
+		case "drop_tags":
+			if len(rule.Drop) == 0 {
+				return nil, fmt.Errorf("drop_tags rule without tags to drop")
+			}
+		default:
+			return nil, fmt.Errorf("unknown filter action: %q", rule.Action)
+		}
+	}
+	return rules, nil
+}
+
+// Points are kept if they match any include rule (or there are none) and no
+// exclude rule. drop_tags rules remove the listed tags from matching points;
+// fields are left alone.
+func filterMetrics(metrics []*Metric) []*Metric {
+	if len(filterRules) == 0 {
+		return metrics
+	}
+
+	result := make([]*Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		rules := []*FilterRule{}
+		hasInclude := false
+		for _, rule := range filterRules {
+			if rule.Action == "include" {
+				hasInclude = true
+			}
+			if rule.Metric.MatchValue(metric.Name) {
+				rules = append(rules, rule)
+			}
+		}
+
+		points := metric.Points[:0]
+		for _, point := range metric.Points {
+			included := !hasInclude
+			excluded := false
+			for _, rule := range rules {
+				if !rule.matchPoint(point) {
+					continue
+				}
+				switch rule.Action {
+				case "include":
+					included = true
+				case "exclude":
+					excluded = true
+				case "drop_tags":
+					for _, k := range rule.Drop {
+						delete(point.Tags, k)
+					}
+				}
+			}
+			if included && !excluded {
+				points = append(points, point)
+			}
+		}
+		metric.Points = points
+		if len(points) > 0 {
+			result = append(result, metric)
+		}
+	}
+	return result
+}
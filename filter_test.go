@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDropTagsLeavesFieldsAlone(t *testing.T) {
+	defer func(rules []*FilterRule) { filterRules = rules }(filterRules)
+	filterRules = []*FilterRule{{Action: "drop_tags", Drop: []string{"value", "env"}}}
+
+	metric := NewMetric("app.requests")
+	point := NewPoint(0, "web-01")
+	point.SetTag("env", "prod")
+	point.SetField("value", 1.0)
+	metric.Add(point)
+
+	result := filterMetrics([]*Metric{metric})
+	if len(result) != 1 {
+		t.Fatalf("got %d metrics, want 1", len(result))
+	}
+	point = result[0].Points[0]
+	if _, ok := point.Tags["env"]; ok {
+		t.Errorf("tag was not dropped: %v", point.Tags)
+	}
+	if _, ok := point.Fields["value"]; !ok {
+		t.Errorf("field was dropped: %v", point.Fields)
+	}
+}
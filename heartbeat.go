@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type hostStatus struct {
+	lastSeen time.Time
+	down     bool
+}
+
+// Heartbeat tracks when each host last reported, and emits an event whenever
+// a host has been silent for longer than Timeout or starts reporting again.
+type Heartbeat struct {
+	sync.Mutex
+	Timeout time.Duration
+
+	hosts map[string]*hostStatus
+}
+
+var heartbeat *Heartbeat
+
+func NewHeartbeat(timeout time.Duration) *Heartbeat {
+	return &Heartbeat{Timeout: timeout, hosts: make(map[string]*hostStatus)}
+}
+
+func (self *Heartbeat) Touch(host string) {
+	if len(host) == 0 {
+		return
+	}
+	self.Lock()
+	now := time.Now()
+	status, ok := self.hosts[host]
+	if !ok {
+		self.hosts[host] = &hostStatus{lastSeen: now}
+		self.Unlock()
+		return
+	}
+	var event map[string]interface{}
+	if status.down {
+		event = map[string]interface{}{
+			"msg_title":  fmt.Sprintf("%s is reporting again", host),
+			"msg_text":   fmt.Sprintf("%s resumed reporting after %v of silence", host, now.Sub(status.lastSeen)),
+			"timestamp":  now.Unix(),
+			"host":       host,
+			"alert_type": "success",
+			"event_type": "host.up",
+			"source":     "dd-house",
+		}
+		status.down = false
+	}
+	status.lastSeen = now
+	self.Unlock()
+
+	// Sending may block, so it must happen without the lock held.
+	if event != nil {
+		log.Printf("Host %s is reporting again\n", host)
+		emitEvent(event)
+	}
+}
+
+// Seed adds hosts known from an earlier run, so that hosts that went silent
+// before a restart are still reported.
+func (self *Heartbeat) Seed(hosts []*HostInfo) {
+	self.Lock()
+	defer self.Unlock()
+
+	for _, info := range hosts {
+		if _, ok := self.hosts[info.Name]; !ok {
+			self.hosts[info.Name] = &hostStatus{lastSeen: info.LastSeen}
+		}
+	}
+}
+
+// Check flags hosts that have gone silent and returns a host.up point for
+// every known host.
+func (self *Heartbeat) Check(now time.Time) *Metric {
+	self.Lock()
+	names := make([]string, 0, len(self.hosts))
+	for name := range self.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	timestamp := timeToTimestamp(now)
+	metric := NewMetric("host.up")
+	events := []map[string]interface{}{}
+	for _, host := range names {
+		status := self.hosts[host]
+		if !status.down && now.Sub(status.lastSeen) > self.Timeout {
+			events = append(events, map[string]interface{}{
+				"msg_title":  fmt.Sprintf("%s stopped reporting", host),
+				"msg_text":   fmt.Sprintf("No data from %s since %s", host, status.lastSeen.Format(time.RFC3339)),
+				"timestamp":  now.Unix(),
+				"host":       host,
+				"alert_type": "error",
+				"event_type": "host.down",
+				"source":     "dd-house",
+			})
+			status.down = true
+		}
+
+		up := 1
+		if status.down {
+			up = 0
+		}
+		point := NewPoint(timestamp, host)
+		point.SetField("value", up)
+		point.SetField("last_seen", status.lastSeen.UnixNano()/int64(time.Millisecond))
+		metric.Add(point)
+	}
+	self.Unlock()
+
+	for _, event := range events {
+		log.Printf("Host %s stopped reporting\n", event["host"])
+		emitEvent(event)
+	}
+	return metric
+}
+
+func (self *Heartbeat) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		metric := self.Check(now)
+		if len(metric.Points) > 0 {
+			PushMetrics([]*Metric{metric})
+		}
+	}
+}
+
+func touchHost(host string) {
+	if heartbeat != nil {
+		heartbeat.Touch(host)
+	}
+}
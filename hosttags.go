@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HostTagCache remembers the host tags each agent reported in its last
+// metadata payload, so they can be added to all of that host's series.
+type HostTagCache struct {
+	sync.RWMutex
+	Keys []string
+
+	hosts map[string]map[string][]string
+}
+
+var hostTags = &HostTagCache{hosts: make(map[string]map[string][]string)}
+
+func toStringSlice(value interface{}) []string {
+	tmp, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	result := make([]string, 0, len(tmp))
+	for _, v := range tmp {
+		if str, ok := v.(string); ok {
+			result = append(result, str)
+		}
+	}
+	return result
+}
+
+// Replaces the tags the host last reported from source.
+func (self *HostTagCache) set(host, source string, tags map[string]interface{}) {
+	sources, ok := self.hosts[host]
+	if !ok {
+		sources = make(map[string][]string)
+		self.hosts[host] = sources
+	}
+	for k := range sources {
+		if strings.HasPrefix(k, source+":") {
+			delete(sources, k)
+		}
+	}
+	for k, v := range tags {
+		sources[source+":"+k] = toStringSlice(v)
+	}
+}
+
+// Update reads host-tags and external_host_tags from an intake payload.
+// external_host_tags is either a map of source to tags for this host, or a
+// list of [hostname, {source: tags}] pairs.
+func (self *HostTagCache) Update(host string, data map[string]interface{}) {
+	self.Lock()
+	defer self.Unlock()
+
+	if tags, ok := data["host-tags"].(map[string]interface{}); ok {
+		self.set(host, "host", tags)
+	}
+	switch external := data["external_host_tags"].(type) {
+	case map[string]interface{}:
+		self.set(host, "external", external)
+	case []interface{}:
+		for _, tmp := range external {
+			entry, ok := tmp.([]interface{})
+			if !ok || len(entry) != 2 {
+				continue
+			}
+			name, _ := entry[0].(string)
+			tags, _ := entry[1].(map[string]interface{})
+			if len(name) > 0 && tags != nil {
+				self.set(name, "external", tags)
+			}
+		}
+	}
+}
+
+// Tags returns the host's tags as key/value pairs. Tags without a value map
+// to an empty string, and the distinct values of repeated keys are joined
+// with commas, in the order of their sources.
+func (self *HostTagCache) Tags(host string) map[string]string {
+	self.RLock()
+	defer self.RUnlock()
+
+	sources := make([]string, 0, len(self.hosts[host]))
+	for source := range self.hosts[host] {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	values := make(map[string][]string)
+	for _, source := range sources {
+		for _, tag := range self.hosts[host][source] {
+			split := strings.SplitN(tag, ":", 2)
+			key := split[0]
+			if _, ok := values[key]; !ok {
+				values[key] = []string{}
+			}
+			if len(split) < 2 || len(split[1]) == 0 || containsString(values[key], split[1]) {
+				continue
+			}
+			values[key] = append(values[key], split[1])
+		}
+	}
+
+	result := make(map[string]string, len(values))
+	for key, list := range values {
+		result[key] = strings.Join(list, ",")
+	}
+	return result
+}
+
+func containsString(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the configured host tag keys as tags to every point, unless the point
+// already has a tag or field with that name.
+func enrichMetrics(metrics []*Metric) []*Metric {
+	if len(hostTags.Keys) == 0 {
+		return metrics
+	}
+
+	cache := make(map[string]map[string]string)
+	for _, metric := range metrics {
+		for _, point := range metric.Points {
+			host, ok := point.Tags["hostname"]
+			if !ok {
+				continue
+			}
+			tags, ok := cache[host]
+			if !ok {
+				tags = hostTags.Tags(host)
+				cache[host] = tags
+			}
+			for _, key := range hostTags.Keys {
+				value, ok := tags[key]
+				if !ok {
+					continue
+				}
+				if _, exists := point.Lookup(key); !exists {
+					point.Tags[key] = value
+				}
+			}
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestHostTagsAreStableAndFollowTheLatestPayload(t *testing.T) {
+	cache := &HostTagCache{hosts: make(map[string]map[string][]string)}
+	cache.Update("web-01", map[string]interface{}{
+		"host-tags": map[string]interface{}{
+			"system": []interface{}{"role:web", "env:prod"},
+			"google": []interface{}{"role:frontend"},
+			"aws":    []interface{}{"role:web", "zone"},
+		},
+	})
+	for i := 0; i < 20; i++ {
+		tags := cache.Tags("web-01")
+		if tags["role"] != "web,frontend" || tags["env"] != "prod" || tags["zone"] != "" {
+			t.Fatalf("unexpected tags: %v", tags)
+		}
+	}
+
+	cache.Update("web-01", map[string]interface{}{
+		"host-tags": map[string]interface{}{
+			"system": []interface{}{"role:web"},
+		},
+	})
+	tags := cache.Tags("web-01")
+	if _, ok := tags["env"]; ok || tags["role"] != "web" || len(tags) != 1 {
+		t.Errorf("tags left out of the latest payload were kept: %v", tags)
+	}
+}
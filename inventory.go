@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HostInfo struct {
+	Name         string                 `json:"name"`
+	LastSeen     time.Time              `json:"last_seen"`
+	AgentVersion string                 `json:"agent_version,omitempty"`
+	OS           string                 `json:"os,omitempty"`
+	Platform     string                 `json:"platform,omitempty"`
+	Python       string                 `json:"python_version,omitempty"`
+	SystemStats  map[string]interface{} `json:"system_stats,omitempty"`
+	Tags         map[string]string      `json:"tags,omitempty"`
+	Aliases      []string               `json:"aliases,omitempty"`
+	Stale        bool                   `json:"stale"`
+}
+
+// Inventory keeps the last known metadata of every host that has posted to
+// /intake. Hosts are flagged as stale once they haven't reported within
+// StaleAfter. The inventory is only saved to and loaded from Path if it is set.
+type Inventory struct {
+	sync.Mutex
+	Path       string
+	StaleAfter time.Duration
+
+	hosts map[string]*HostInfo
+	dirty bool
+}
+
+var inventory *Inventory
+
+func NewInventory(path string, staleAfter time.Duration) (*Inventory, error) {
+	self := &Inventory{Path: path, StaleAfter: staleAfter, hosts: make(map[string]*HostInfo)}
+	if len(path) == 0 {
+		return self, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return self, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(buf, &self.hosts)
+	if err != nil {
+		return nil, err
+	}
+	if self.hosts == nil {
+		self.hosts = make(map[string]*HostInfo)
+	}
+	return self, nil
+}
+
+func (self *Inventory) Update(host string, data map[string]interface{}) {
+	self.Lock()
+	defer self.Unlock()
+
+	info, ok := self.hosts[host]
+	if !ok {
+		info = &HostInfo{Name: host}
+		self.hosts[host] = info
+	}
+	info.LastSeen = time.Now()
+	self.dirty = true
+
+	if version, ok := data["agentVersion"].(string); ok {
+		info.AgentVersion = version
+	}
+	if osName, ok := data["os"].(string); ok {
+		info.OS = osName
+	}
+	if python, ok := data["python"].(string); ok {
+		info.Python = python
+	}
+
+	if stats, ok := data["systemStats"].(map[string]interface{}); ok {
+		info.SystemStats = make(map[string]interface{})
+		for k, v := range stats {
+			info.SystemStats[k] = v
+		}
+		if platform, ok := stats["platform"].(string); ok {
+			info.Platform = platform
+		}
+	}
+
+	if meta, ok := data["meta"].(map[string]interface{}); ok {
+		aliases := []string{}
+		seen := map[string]bool{host: true}
+		for _, key := range []string{"hostname", "socket-hostname", "socket-fqdn", "ec2-hostname"} {
+			if alias, ok := meta[key].(string); ok && len(alias) > 0 && !seen[alias] {
+				seen[alias] = true
+				aliases = append(aliases, alias)
+			}
+		}
+		for _, alias := range toStringSlice(meta["host_aliases"]) {
+			if !seen[alias] {
+				seen[alias] = true
+				aliases = append(aliases, alias)
+			}
+		}
+		info.Aliases = aliases
+	}
+
+	if data["host-tags"] != nil || data["external_host_tags"] != nil {
+		info.Tags = hostTags.Tags(host)
+	}
+}
+
+func (self *Inventory) copyHost(info *HostInfo, now time.Time) *HostInfo {
+	result := *info
+	result.Stale = now.Sub(info.LastSeen) > self.StaleAfter
+	return &result
+}
+
+func (self *Inventory) Hosts() []*HostInfo {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now()
+	names := make([]string, 0, len(self.hosts))
+	for name := range self.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hosts := make([]*HostInfo, len(names))
+	for i, name := range names {
+		hosts[i] = self.copyHost(self.hosts[name], now)
+	}
+	return hosts
+}
+
+func (self *Inventory) Host(name string) *HostInfo {
+	self.Lock()
+	defer self.Unlock()
+
+	info, ok := self.hosts[name]
+	if !ok {
+		return nil
+	}
+	return self.copyHost(info, time.Now())
+}
+
+func (self *Inventory) Save() error {
+	self.Lock()
+	if !self.dirty || len(self.Path) == 0 {
+		self.Unlock()
+		return nil
+	}
+	buf, err := json.MarshalIndent(self.hosts, "", "  ")
+	self.dirty = false
+	self.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := self.Path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, self.Path)
+}
+
+func (self *Inventory) Run(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		err := self.Save()
+		if err != nil {
+			log.Println("Failed to save host inventory:", err)
+		}
+	}
+}
+
+func handleHosts(w http.ResponseWriter, req *http.Request) {
+	_, handled := handleApiKey(w, req)
+	if handled {
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, "/hosts"), "/")
+	if len(name) == 0 {
+		writeJSON(w, inventory.Hosts())
+		return
+	}
+	info := inventory.Host(name)
+	if info == nil {
+		http.Error(w, "Unknown host", 404)
+		return
+	}
+	writeJSON(w, info)
+}
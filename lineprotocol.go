@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The line protocol has no escape for line breaks, so they are written as a
+// literal \n or \r to keep every point on one line.
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`, "\r", `\r`)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`, "\r", `\r`)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`, "\r", `\r`)
+)
+
+func lineValue(value Value) string {
+	switch value.Type {
+	case FloatType:
+		return strconv.FormatFloat(value.f, 'g', -1, 64)
+	case IntType:
+		return strconv.FormatInt(value.i, 10) + "i"
+	case StringType:
+		return `"` + stringEscaper.Replace(value.s) + `"`
+	}
+	return strconv.FormatBool(value.b)
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// EncodeLines writes each point of metric in the InfluxDB line protocol.
+// Empty tags are left out, and points without fields are skipped since the
+// line protocol can't represent them.
+func EncodeLines(metric *Metric, precision string) []string {
+	lines := []string{}
+	measurement := measurementEscaper.Replace(metric.Name)
+	for _, point := range metric.Points {
+		if len(point.Fields) == 0 {
+			continue
+		}
+		line := measurement
+		for _, k := range sortedKeys(point.Tags) {
+			if v := point.Tags[k]; len(v) > 0 {
+				line += "," + tagEscaper.Replace(k) + "=" + tagEscaper.Replace(v)
+			}
+		}
+
+		fields := make([]string, 0, len(point.Fields))
+		for k, v := range point.Fields {
+			fields = append(fields, tagEscaper.Replace(k)+"="+lineValue(v))
+		}
+		sort.Strings(fields)
+		line += " " + strings.Join(fields, ",")
+		line += " " + strconv.FormatUint(convertTimestamp(point.Time, precision), 10)
+		lines = append(lines, line)
+	}
+	return lines
+}
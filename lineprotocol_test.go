@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeLinesKeepsPointsOnOneLine(t *testing.T) {
+	metric := NewMetric("host.meta")
+	point := NewPoint(1, "db-01")
+	point.SetTag("note", "a\nb")
+	point.SetField("python_version", "2.7.16\r\n[GCC 4.4.7]")
+	metric.Add(point)
+
+	lines := EncodeLines(metric, "ns")
+	if len(lines) != 1 || strings.ContainsAny(lines[0], "\r\n") {
+		t.Fatalf("point was split across lines: %q", lines)
+	}
+	want := `host.meta,hostname=db-01,note=a\nb python_version="2.7.16\r\n[GCC 4.4.7]" 1`
+	if lines[0] != want {
+		t.Errorf("got %s, want %s", lines[0], want)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Run "go test -run TestMapping -update" to rewrite the golden files after an
+// intentional change to the mapping.
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Every setting that configure reads, so the goldens don't depend on the
+// environment the tests happen to run in.
+var configEnv = []string{
+	"PS_FILTER", "PS_GROUP_BY", "PS_TOP_N", "PS_TOP_BY", "PS_FAMILY_RULES", "PS_WATCH",
+	"PS_SCRUB_PATTERNS", "PS_COMMAND_MAX", "DISK_DEVICE_INCLUDE", "DISK_DEVICE_EXCLUDE",
+	"DISK_MOUNT_INCLUDE", "DISK_MOUNT_EXCLUDE", "DISK_FSTYPE_INCLUDE", "DISK_FSTYPE_EXCLUDE", "DISK_DEDUPE",
+	"STATSD_TYPES", "CARDINALITY_MAX_KEYS", "CARDINALITY_MAX_VALUES", "CARDINALITY_BUCKETS",
+	"CARDINALITY_ACTION", "CUMULATIVE_METRICS", "CUMULATIVE_TTL", "HOST_TAGS", "FILTER_RULES",
+	"RELABEL_RULES", "DB_URL", "DB_PRECISION", "SKEW_MODE", "SKEW_WINDOW", "FIELD_TYPES",
+	"FIELD_CONFLICT", "FIELD_TYPES_TTL", "QUARANTINE_DB",
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	for _, key := range configEnv {
+		os.Unsetenv(key)
+	}
+	configure()
+	os.Exit(m.Run())
+}
+
+// Each payload starts from the state of a freshly started server.
+func resetMappingState() {
+	serviceChecks = &ServiceCheckTracker{states: make(map[string]*ServiceCheckState)}
+	agentChecks = &AgentCheckSummary{results: make(map[string]*AgentCheckResult)}
+	hostTags = &HostTagCache{hosts: make(map[string]map[string][]string)}
+}
+
+// Runs the mappers on a payload and renders the result the way translate
+// prints it. Intake keys that no mapper consumed are listed first, so new
+// fields from an agent release show up in the diff.
+func mapPayload(path string, body []byte) ([]byte, error) {
+	resetMappingState()
+	buf := &bytes.Buffer{}
+	var metrics []*Metric
+	switch filepath.Base(filepath.Dir(path)) {
+	case "intake":
+		data := make(map[string]interface{})
+		err := json.Unmarshal(body, &data)
+		if err != nil {
+			return nil, err
+		}
+		metrics = mapMetrics(data, false)
+		unprocessed := make([]string, 0, len(data))
+		for key := range data {
+			unprocessed = append(unprocessed, key)
+		}
+		sort.Strings(unprocessed)
+		if len(unprocessed) == 0 {
+			unprocessed = append(unprocessed, "none")
+		}
+		fmt.Fprintf(buf, "unprocessed: %s\n\n", strings.Join(unprocessed, ", "))
+	case "series":
+		series := StatsdSeries{}
+		err := json.Unmarshal(body, &series)
+		if err != nil {
+			return nil, err
+		}
+		metrics = mapStatsd(series.Series, false)
+	default:
+		return nil, fmt.Errorf("unknown payload type for %s", path)
+	}
+	sortMetrics(metrics)
+	buf.Write(encodeTable(metrics))
+	return buf.Bytes(), nil
+}
+
+// Describes the first line where got and want differ.
+func firstDifference(got, want []byte) string {
+	gotLines := strings.Split(string(got), "\n")
+	wantLines := strings.Split(string(want), "\n")
+	for i := 0; i < len(gotLines) || i < len(wantLines); i++ {
+		var g, w string
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if g != w {
+			return fmt.Sprintf("line %d:\n got: %q\nwant: %q", i+1, g, w)
+		}
+	}
+	return ""
+}
+
+func TestMapping(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no payloads in testdata")
+	}
+	for _, path := range paths {
+		path := path
+		t.Run(strings.TrimSuffix(strings.TrimPrefix(path, "testdata"+string(filepath.Separator)), ".json"), func(t *testing.T) {
+			body, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := mapPayload(path, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := strings.TrimSuffix(path, ".json") + ".golden"
+			if *update {
+				err = ioutil.WriteFile(golden, got, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v; run go test -update to create it", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("mapping differs from %s at %s\nrun go test -update if the change is intended", golden, firstDifference(got, want))
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ValueType int
+
+const (
+	FloatType ValueType = iota
+	IntType
+	StringType
+	BoolType
+)
+
+var valueTypeNames = map[ValueType]string{
+	FloatType:  "float",
+	IntType:    "int",
+	StringType: "string",
+	BoolType:   "bool",
+}
+
+func (self ValueType) String() string {
+	return valueTypeNames[self]
+}
+
+// Value is a single field value. Only the member matching Type is set.
+type Value struct {
+	Type ValueType
+	f    float64
+	i    int64
+	s    string
+	b    bool
+}
+
+func FloatValue(v float64) Value {
+	return Value{Type: FloatType, f: v}
+}
+
+func IntValue(v int64) Value {
+	return Value{Type: IntType, i: v}
+}
+
+func StringValue(v string) Value {
+	return Value{Type: StringType, s: v}
+}
+
+func BoolValue(v bool) Value {
+	return Value{Type: BoolType, b: v}
+}
+
+// NewValue converts a decoded JSON value, or one of the Go types the mappers
+// produce, into a Value. Lists are joined with commas. It returns false for
+// nil.
+func NewValue(value interface{}) (Value, bool) {
+	switch v := value.(type) {
+	case nil:
+		return Value{}, false
+	case Value:
+		return v, true
+	case float64:
+		return FloatValue(v), true
+	case float32:
+		return FloatValue(float64(v)), true
+	case int:
+		return IntValue(int64(v)), true
+	case int64:
+		return IntValue(v), true
+	case uint64:
+		// InfluxDB integers are signed, so larger values are clamped
+		if v > math.MaxInt64 {
+			return IntValue(math.MaxInt64), true
+		}
+		return IntValue(int64(v)), true
+	case string:
+		return StringValue(v), true
+	case bool:
+		return BoolValue(v), true
+	case []interface{}:
+		return StringValue(tagString(v)), true
+	}
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return StringValue(fmt.Sprint(value)), true
+	}
+	return StringValue(string(buf)), true
+}
+
+func (self Value) Interface() interface{} {
+	switch self.Type {
+	case IntType:
+		return self.i
+	case StringType:
+		return self.s
+	case BoolType:
+		return self.b
+	}
+	return self.f
+}
+
+// Float returns the value as a float64 if it is numeric.
+func (self Value) Float() (float64, bool) {
+	switch self.Type {
+	case FloatType:
+		return self.f, true
+	case IntType:
+		return float64(self.i), true
+	}
+	return 0, false
+}
+
+// Str formats the value the way it would be written as a tag.
+func (self Value) Str() string {
+	switch self.Type {
+	case FloatType:
+		return strconv.FormatFloat(self.f, 'f', -1, 64)
+	case IntType:
+		return strconv.FormatInt(self.i, 10)
+	case StringType:
+		return self.s
+	}
+	return strconv.FormatBool(self.b)
+}
+
+func (self Value) MarshalJSON() ([]byte, error) {
+	return json.Marshal(self.Interface())
+}
+
+// Tags are always strings. Lists of tags are joined with commas.
+func tagString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, part := range v {
+			parts[i] = tagString(part)
+		}
+		return strings.Join(parts, ",")
+	}
+	if v, ok := NewValue(value); ok {
+		return v.Str()
+	}
+	return fmt.Sprint(value)
+}
+
+// Point is a single sample: a timestamp in nanoseconds, the tags identifying
+// its series, and one or more typed fields.
+type Point struct {
+	Time   uint64            `json:"time"`
+	Tags   map[string]string `json:"tags"`
+	Fields map[string]Value  `json:"fields"`
+}
+
+func NewPoint(timestamp uint64, host string) *Point {
+	self := &Point{timestamp, make(map[string]string), make(map[string]Value)}
+	if len(host) > 0 {
+		self.Tags["hostname"] = host
+	}
+	return self
+}
+
+func (self *Point) SetTag(key string, value interface{}) {
+	self.Tags[key] = tagString(value)
+}
+
+// SetField ignores nil values, so missing agent values leave the field unset.
+func (self *Point) SetField(key string, value interface{}) {
+	if v, ok := NewValue(value); ok {
+		self.Fields[key] = v
+	}
+}
+
+func (self *Point) Host() string {
+	return self.Tags["hostname"]
+}
+
+// Lookup returns a tag, or failing that a field formatted as a string.
+func (self *Point) Lookup(key string) (string, bool) {
+	if tag, ok := self.Tags[key]; ok {
+		return tag, true
+	}
+	if field, ok := self.Fields[key]; ok {
+		return field.Str(), true
+	}
+	return "", false
+}
+
+func (self *Point) Copy() *Point {
+	point := &Point{self.Time, make(map[string]string, len(self.Tags)), make(map[string]Value, len(self.Fields))}
+	for k, v := range self.Tags {
+		point.Tags[k] = v
+	}
+	for k, v := range self.Fields {
+		point.Fields[k] = v
+	}
+	return point
+}
+
+// A series is identified by its name and the tags of the point.
+func (self *Point) SeriesKey(name string) string {
+	tags := make([]string, 0, len(self.Tags))
+	for k, v := range self.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return name + "|" + strings.Join(tags, ",")
+}
+
+type Metric struct {
+	Name   string   `json:"name"`
+	Points []*Point `json:"points"`
+}
+
+func NewMetric(name string) *Metric {
+	return &Metric{name, []*Point{}}
+}
+
+func (self *Metric) Add(point *Point) {
+	self.Points = append(self.Points, point)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+type FamilyRule struct {
+	Family string `json:"family"`
+	Regex  string `json:"regex"`
+
+	regex *regexp.Regexp
+}
+
+var (
+	processGroupBy = "command"
+	processTopN    = 0
+	processTopBy   = "cpu"
+	familyRules    []*FamilyRule
+)
+
+func loadFamilyRules(path string) ([]*FamilyRule, error) {
+	rules := []*FamilyRule{}
+	err := loadJSONConfig(path, &rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if len(rule.Family) == 0 {
+			return nil, fmt.Errorf("family rule for %q needs a family", rule.Regex)
+		}
+		rule.regex, err = regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func checkProcessGroupBy(groupBy string) error {
+	switch groupBy {
+	case "command", "family", "user", "family+user":
+		return nil
+	}
+	return fmt.Errorf("unknown process grouping: %q", groupBy)
+}
+
+func checkProcessTopBy(topBy string) error {
+	switch topBy {
+	case "cpu", "mem":
+		return nil
+	}
+	return fmt.Errorf("unknown process top-N field: %q", topBy)
+}
+
+// Kernel threads are always grouped into a single "kernel" family.
+func processFamily(command string) string {
+	if len(command) > 0 && command[0] == '[' {
+		return "kernel"
+	}
+	for _, rule := range familyRules {
+		if rule.regex.MatchString(command) {
+			return rule.Family
+		}
+	}
+	return GetProcessFamily(command)
+}
+
+func processGroupKey(user, family, command string) string {
+	switch processGroupBy {
+	case "family":
+		return family
+	case "user":
+		return user
+	case "family+user":
+		return family + "\x00" + user
+	}
+	if family == "kernel" {
+		return family
+	}
+	return command
+}
+
+// processGroup sums the resource usage of all processes with the same group
+// key. When grouping by command the pid and user are those of the first
+// process seen; other groupings only report the tags they group by.
+type processGroup struct {
+	user, family, command string
+	pid, vsz, rss         int64
+	pctCpu, pctMem        float64
+	count                 int
+}
+
+func (self *processGroup) Point(timestamp uint64, host string) *Point {
+	point := NewPoint(timestamp, host)
+	switch processGroupBy {
+	case "family":
+		point.SetTag("family", self.family)
+	case "user":
+		point.SetTag("user", self.user)
+	case "family+user":
+		point.SetTag("family", self.family)
+		point.SetTag("user", self.user)
+	default:
+		point.SetTag("user", self.user)
+		point.SetTag("family", self.family)
+		point.SetTag("command", truncateCommand(self.command))
+		point.SetField("pid", self.pid)
+	}
+	point.SetField("pct_cpu", self.pctCpu)
+	point.SetField("pct_mem", self.pctMem)
+	point.SetField("vsz", self.vsz)
+	point.SetField("rss", self.rss)
+	point.SetField("ps_count", self.count)
+	return point
+}
+
+// Keeps the n processes using the most cpu or memory, depending on
+// PS_TOP_BY.
+func topProcesses(processes []*processGroup, n int) []*processGroup {
+	if n <= 0 || len(processes) <= n {
+		return processes
+	}
+	sort.SliceStable(processes, func(i, j int) bool {
+		if processTopBy == "mem" {
+			return processes[i].pctMem > processes[j].pctMem
+		}
+		return processes[i].pctCpu > processes[j].pctCpu
+	})
+	return processes[:n]
+}
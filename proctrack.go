@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type trackedProcess struct {
+	pid     int64
+	started string
+	command string
+	first   time.Time
+}
+
+// ProcessTracker follows individual processes matching Watch, identified by
+// host, pid and command, and reports when they start and exit. The start time
+// isn't part of the identity, as ps switches it from HH:MM to MmmDD once a
+// process is a day old.
+type ProcessTracker struct {
+	sync.Mutex
+	Watch []*Pattern
+
+	hosts map[string]map[string]*trackedProcess
+}
+
+var processTracker *ProcessTracker
+
+func NewProcessTracker(watch string) (*ProcessTracker, error) {
+	self := &ProcessTracker{hosts: make(map[string]map[string]*trackedProcess)}
+	for _, str := range strings.Split(watch, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+		pattern, err := CompilePattern(str)
+		if err != nil {
+			return nil, err
+		}
+		self.Watch = append(self.Watch, pattern)
+	}
+	return self, nil
+}
+
+func (self *ProcessTracker) watched(family, command string) bool {
+	for _, pattern := range self.Watch {
+		if pattern.MatchString(family) || pattern.MatchString(command) {
+			return true
+		}
+	}
+	return false
+}
+
+// Update takes the raw ps rows of one payload and returns a point for every
+// watched process. Start events are not sent for the first payload seen from
+// a host, since those processes were already running.
+func (self *ProcessTracker) Update(host string, timestamp uint64, processes []interface{}) *Metric {
+	metric, events := self.update(host, timestamp, processes)
+	// Sending may block, so it must happen without the lock held.
+	for _, event := range events {
+		emitEvent(event)
+	}
+	return metric
+}
+
+func (self *ProcessTracker) update(host string, timestamp uint64, processes []interface{}) (*Metric, []map[string]interface{}) {
+	self.Lock()
+	defer self.Unlock()
+
+	now := timestampToTime(timestamp)
+	previous, known := self.hosts[host]
+	current := make(map[string]*trackedProcess)
+	metric := NewMetric("processes.watch")
+	events := []map[string]interface{}{}
+
+	for _, process := range processes {
+		fields := process.([]interface{})
+		command := scrubCommand(fields[10].(string))
+		family := processFamily(command)
+		if !self.watched(family, command) {
+			continue
+		}
+
+		pid, _ := strconv.ParseInt(fields[1].(string), 10, 64)
+		started := fields[8].(string)
+		key := fmt.Sprintf("%d|%s", pid, command)
+		tracked, ok := previous[key]
+		if ok {
+			tracked.started = started
+		} else {
+			tracked = &trackedProcess{pid, started, command, now}
+			if known {
+				events = append(events, map[string]interface{}{
+					"msg_title":  fmt.Sprintf("%s started on %s", family, host),
+					"msg_text":   fmt.Sprintf("pid %d started at %s: %s", pid, started, command),
+					"timestamp":  now.Unix(),
+					"host":       host,
+					"alert_type": "info",
+					"event_type": "process.start",
+					"source":     "dd-house",
+				})
+			}
+		}
+		current[key] = tracked
+
+		pctCpu, _ := strconv.ParseFloat(fields[2].(string), 64)
+		pctMem, _ := strconv.ParseFloat(fields[3].(string), 64)
+		vsz, _ := strconv.ParseInt(fields[4].(string), 10, 64)
+		rss, _ := strconv.ParseInt(fields[5].(string), 10, 64)
+		point := NewPoint(timestamp, host)
+		point.SetTag("user", fields[0])
+		point.SetTag("family", family)
+		point.SetTag("command", truncateCommand(command))
+		point.SetTag("started", started)
+		point.SetField("pid", pid)
+		point.SetField("running_time", fields[9])
+		point.SetField("tty", fields[6])
+		point.SetField("stat", fields[7])
+		point.SetField("pct_cpu", pctCpu)
+		point.SetField("pct_mem", pctMem)
+		point.SetField("vsz", vsz)
+		point.SetField("rss", rss)
+		metric.Add(point)
+	}
+
+	for key, tracked := range previous {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		text := fmt.Sprintf("pid %d started at %s is no longer running after being tracked for %v: %s",
+			tracked.pid, tracked.started, now.Sub(tracked.first), tracked.command)
+		events = append(events, map[string]interface{}{
+			"msg_title":  fmt.Sprintf("%s exited on %s", processFamily(tracked.command), host),
+			"msg_text":   text,
+			"timestamp":  now.Unix(),
+			"host":       host,
+			"alert_type": "warning",
+			"event_type": "process.exit",
+			"source":     "dd-house",
+		})
+	}
+	self.hosts[host] = current
+
+	if len(metric.Points) == 0 {
+		return nil, events
+	}
+	return metric, events
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func psRow(pid, started, command string) []interface{} {
+	return []interface{}{"postgres", pid, "0.5", "1.0", "1000", "500", "?", "Ss", started, "0:01", command}
+}
+
+func TestProcessTrackerIgnoresStartFormatChange(t *testing.T) {
+	defer func(e chan []byte) { eventsChan = e }(eventsChan)
+	eventsChan = make(chan []byte, 10)
+
+	tracker, err := NewProcessTracker("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := timeToTimestamp(time.Now())
+	tracker.Update("db-01", now, []interface{}{psRow("200", "09:41", "postgres -D /data")})
+	tracker.Update("db-01", now+uint64(24*time.Hour), []interface{}{psRow("200", "Jun01", "postgres -D /data")})
+	if len(eventsChan) != 0 {
+		t.Fatalf("got %d events for a process that kept running", len(eventsChan))
+	}
+
+	tracker.Update("db-01", now+uint64(25*time.Hour), []interface{}{psRow("300", "10:41", "postgres -D /data")})
+	if len(eventsChan) != 2 {
+		t.Errorf("got %d events for a restarted process, want a start and an exit", len(eventsChan))
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits are expressed as requests per second, points per minute and
+// bytes per minute. A zero value disables that limit.
+type Limits struct {
+	Requests float64
+	Points   float64
+	Bytes    float64
+}
+
+func ParseLimits(s string) (Limits, error) {
+	limits := Limits{}
+	if len(s) == 0 {
+		return limits, nil
+	}
+	for _, part := range strings.Split(s, ":") {
+		split := strings.SplitN(part, "=", 2)
+		if len(split) != 2 {
+			return limits, fmt.Errorf("invalid limit: %q", part)
+		}
+		value, err := strconv.ParseFloat(split[1], 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid limit: %q: %v", part, err)
+		}
+		switch split[0] {
+		case "requests":
+			limits.Requests = value
+		case "points":
+			limits.Points = value
+		case "bytes":
+			limits.Bytes = value
+		default:
+			return limits, fmt.Errorf("unknown limit: %q", split[0])
+		}
+	}
+	return limits, nil
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate, burst, burst, now}
+}
+
+func (self *tokenBucket) refill(now time.Time) {
+	self.tokens = math.Min(self.burst, self.tokens+now.Sub(self.last).Seconds()*self.rate)
+	self.last = now
+}
+
+// Returns how long to wait before n tokens can be taken. A full bucket always
+// admits the request, so a single payload larger than the burst is not
+// rejected forever; the bucket goes into debt instead.
+func (self *tokenBucket) wait(n float64) time.Duration {
+	if self.tokens >= n || self.tokens >= self.burst {
+		return 0
+	}
+	return time.Duration((n - self.tokens) / self.rate * float64(time.Second))
+}
+
+type limitBuckets struct {
+	requests *tokenBucket
+	points   *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newLimitBuckets(limits Limits, now time.Time) *limitBuckets {
+	b := &limitBuckets{}
+	if limits.Requests > 0 {
+		b.requests = newTokenBucket(limits.Requests, limits.Requests, now)
+	}
+	if limits.Points > 0 {
+		b.points = newTokenBucket(limits.Points/60, limits.Points, now)
+	}
+	if limits.Bytes > 0 {
+		b.bytes = newTokenBucket(limits.Bytes/60, limits.Bytes, now)
+	}
+	return b
+}
+
+// A bucket that has refilled completely is the same as a new one.
+func (self *limitBuckets) idle(now time.Time) bool {
+	for _, bucket := range []*tokenBucket{self.requests, self.points, self.bytes} {
+		if bucket == nil {
+			continue
+		}
+		bucket.refill(now)
+		if bucket.tokens < bucket.burst {
+			return false
+		}
+	}
+	return true
+}
+
+// LimitKey identifies a set of buckets and the limits they are created with.
+type LimitKey struct {
+	Id     string
+	Limits Limits
+}
+
+const rateLimitSweep = time.Minute
+
+type RateLimiter struct {
+	sync.Mutex
+	buckets map[string]*limitBuckets
+	swept   time.Time
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*limitBuckets), swept: time.Now()}
+}
+
+// Must be called with the lock held.
+func (self *RateLimiter) sweep(now time.Time) {
+	if now.Sub(self.swept) < rateLimitSweep {
+		return
+	}
+	self.swept = now
+	for id, b := range self.buckets {
+		if b.idle(now) {
+			delete(self.buckets, id)
+		}
+	}
+}
+
+// Checks every limit of every key at once and only takes tokens if all of
+// them admit the request. Returns the time to wait and the id of the key that
+// was exceeded.
+func (self *RateLimiter) Take(keys []LimitKey, requests, points, bytes float64) (time.Duration, string) {
+	self.Lock()
+	defer self.Unlock()
+
+	now := time.Now()
+	self.sweep(now)
+
+	amounts := []float64{requests, points, bytes}
+	all := [][]*tokenBucket{}
+	var wait time.Duration
+	var exceeded string
+	for _, key := range keys {
+		b, ok := self.buckets[key.Id]
+		if !ok {
+			b = newLimitBuckets(key.Limits, now)
+			self.buckets[key.Id] = b
+		}
+		buckets := []*tokenBucket{b.requests, b.points, b.bytes}
+		all = append(all, buckets)
+		for i, bucket := range buckets {
+			if bucket == nil || amounts[i] == 0 {
+				continue
+			}
+			bucket.refill(now)
+			if w := bucket.wait(amounts[i]); w > wait {
+				wait = w
+				exceeded = key.Id
+			}
+		}
+	}
+	if wait > 0 {
+		return wait, exceeded
+	}
+	for _, buckets := range all {
+		for i, bucket := range buckets {
+			if bucket != nil {
+				bucket.tokens -= amounts[i]
+			}
+		}
+	}
+	return 0, ""
+}
+
+var (
+	apiKeys         map[string]Limits
+	keyRateLimit    Limits
+	hostRateLimit   Limits
+	rateLimiter     = NewRateLimiter()
+	rateLimitedVars = expvar.NewMap("rate_limited")
+)
+
+// API_KEY is a comma separated list of keys, each optionally followed by its
+// own limits, e.g. "abc123:requests=5:points=60000,def456".
+func parseApiKeys(s string) (map[string]Limits, error) {
+	keys := make(map[string]Limits)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		split := strings.SplitN(entry, ":", 2)
+		limits := keyRateLimit
+		if len(split) > 1 {
+			var err error
+			limits, err = ParseLimits(split[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		keys[split[0]] = limits
+	}
+	return keys, nil
+}
+
+func maskApiKey(key string) string {
+	if len(key) > 4 {
+		return key[:4] + "..."
+	}
+	return key
+}
+
+// Counts the points in a decoded intake payload without mapping it, since
+// mapping updates host, check and counter state. It is an upper bound, as
+// processes are grouped and filtered later.
+func intakePoints(data map[string]interface{}) int {
+	count := 0
+	if data["collection_timestamp"] != nil {
+		groups := make(map[string]bool)
+		for key := range data {
+			if name, ok := rootMetrics[key]; ok {
+				group, _ := GroupMetric(name)
+				groups[group] = true
+			}
+		}
+		count += len(groups)
+		for _, key := range []string{"agent_checks", "diskUsage", "inodes"} {
+			rows, _ := data[key].([]interface{})
+			count += len(rows)
+		}
+		ioStats, _ := data["ioStats"].(map[string]interface{})
+		count += len(ioStats)
+		if processes, ok := data["processes"].(map[string]interface{}); ok {
+			rows, _ := processes["processes"].([]interface{})
+			count += len(rows)
+		}
+	}
+	for _, key := range []string{"meta", "host-tags", "external_host_tags", "systemStats"} {
+		if data[key] != nil {
+			count++
+		}
+	}
+	for _, key := range []string{"external_host_tags", "service_checks", "metrics"} {
+		rows, _ := data[key].([]interface{})
+		count += len(rows)
+	}
+	return count
+}
+
+func seriesPoints(series *StatsdSeries) int {
+	count := 0
+	for _, metric := range series.Series {
+		count += len(metric.Points)
+	}
+	return count
+}
+
+// Returns true if the request was rejected and a 429 has been written.
+func handleRateLimit(w http.ResponseWriter, key, host string, requests, points, bytes int) bool {
+	limits, ok := apiKeys[key]
+	if !ok {
+		limits = keyRateLimit
+	}
+
+	keys := []LimitKey{{"key:" + key, limits}}
+	if len(host) > 0 {
+		keys = append(keys, LimitKey{"host:" + host, hostRateLimit})
+	}
+	wait, id := rateLimiter.Take(keys, float64(requests), float64(points), float64(bytes))
+	if wait == 0 {
+		return false
+	}
+
+	if strings.HasPrefix(id, "key:") {
+		id = "key:" + maskApiKey(key)
+	}
+	rateLimitedVars.Add(id, 1)
+	log.Printf("Rate limited %s, retry in %v\n", id, wait)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Rate limit exceeded", 429)
+	return true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterHostRejectionKeepsKeyTokens(t *testing.T) {
+	limiter := NewRateLimiter()
+	key := LimitKey{"key:abc", Limits{Requests: 2}}
+	host := LimitKey{"host:web-01", Limits{Requests: 1}}
+
+	if wait, _ := limiter.Take([]LimitKey{key, host}, 1, 0, 0); wait != 0 {
+		t.Fatalf("first request waited %v", wait)
+	}
+	wait, id := limiter.Take([]LimitKey{key, host}, 1, 0, 0)
+	if wait == 0 || id != host.Id {
+		t.Fatalf("second request: wait %v, id %q; want the host limit to reject it", wait, id)
+	}
+	// The rejected request must not have used up the key's last token.
+	other := LimitKey{"host:web-02", Limits{Requests: 1}}
+	if wait, id := limiter.Take([]LimitKey{key, other}, 1, 0, 0); wait != 0 {
+		t.Fatalf("request from another host was limited by %q", id)
+	}
+}
+
+func TestRateLimiterEvictsIdleBuckets(t *testing.T) {
+	limiter := NewRateLimiter()
+	limiter.Take([]LimitKey{{"key:abc", Limits{Requests: 100}}}, 1, 0, 0)
+	limiter.Take([]LimitKey{{"key:def", Limits{Requests: 0.001}}}, 1, 0, 0)
+
+	limiter.Lock()
+	limiter.sweep(time.Now().Add(rateLimitSweep))
+	_, abc := limiter.buckets["key:abc"]
+	_, def := limiter.buckets["key:def"]
+	limiter.Unlock()
+	if abc {
+		t.Error("refilled bucket was not evicted")
+	}
+	if !def {
+		t.Error("bucket that is still refilling was evicted")
+	}
+}
+
+func TestIntakePoints(t *testing.T) {
+	data := map[string]interface{}{
+		"collection_timestamp": 1400000000.0,
+		"cpuUser":              1.0,
+		"cpuIdle":              99.0,
+		"system.load.1":        0.5,
+		"diskUsage":            []interface{}{[]interface{}{}, []interface{}{}},
+		"ioStats":              map[string]interface{}{"sda": nil},
+		"metrics":              []interface{}{[]interface{}{}},
+		"meta":                 map[string]interface{}{},
+	}
+	if count := intakePoints(data); count != 7 {
+		t.Errorf("got %d points, want 7", count)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const nameLabel = "__name__"
+
+// RelabelRule follows Prometheus relabel_configs: the values of Source are
+// joined with Separator and matched against Regex, and Target is set to the
+// expanded Replacement. The metric name is available as "__name__". Setting a
+// tag or field to an empty string removes it.
+type RelabelRule struct {
+	Action      string   `json:"action"`
+	Source      []string `json:"source"`
+	Separator   *string  `json:"separator"`
+	Regex       *string  `json:"regex"`
+	Target      string   `json:"target"`
+	Replacement *string  `json:"replacement"`
+
+	separator   string
+	regex       *regexp.Regexp
+	replacement string
+}
+
+var relabelRules []*RelabelRule
+
+func loadRelabelRules(path string) ([]*RelabelRule, error) {
+	rules := []*RelabelRule{}
+	err := loadJSONConfig(path, &rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		switch rule.Action {
+		case "":
+			rule.Action = "replace"
+		case "replace", "lowercase":
+		case "rename":
+			if len(rule.Source) != 1 || len(rule.Target) == 0 {
+				return nil, fmt.Errorf("rename rule needs one source and a target")
+			}
+		default:
+			return nil, fmt.Errorf("unknown relabel action: %q", rule.Action)
+		}
+
+		rule.separator = ";"
+		if rule.Separator != nil {
+			rule.separator = *rule.Separator
+		}
+		regex := "(.*)"
+		if rule.Regex != nil {
+			regex = *rule.Regex
+		}
+		rule.regex, err = regexp.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			return nil, err
+		}
+		rule.replacement = "$1"
+		if rule.Replacement != nil {
+			rule.replacement = *rule.Replacement
+		}
+		if len(rule.Target) == 0 {
+			if rule.Action == "lowercase" && len(rule.Source) == 1 {
+				rule.Target = rule.Source[0]
+			} else if rule.Action != "rename" {
+				return nil, fmt.Errorf("%s rule without a target", rule.Action)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// labelSet holds the metric name, the tags of a point and its fields. A tag
+// and a field may share a name; rules read the tag first. Labels keep their
+// kind when set, and new labels become tags.
+type labelSet struct {
+	name   string
+	tags   map[string]string
+	fields map[string]Value
+}
+
+func pointLabels(name string, point *Point) *labelSet {
+	labels := &labelSet{name, make(map[string]string, len(point.Tags)), make(map[string]Value, len(point.Fields))}
+	for k, v := range point.Tags {
+		labels.tags[k] = v
+	}
+	for k, v := range point.Fields {
+		labels.fields[k] = v
+	}
+	return labels
+}
+
+func (self *labelSet) get(name string) string {
+	if name == nameLabel {
+		return self.name
+	}
+	if tag, ok := self.tags[name]; ok {
+		return tag
+	}
+	if field, ok := self.fields[name]; ok {
+		return field.Str()
+	}
+	return ""
+}
+
+func (self *labelSet) set(name, value string) {
+	if name == nameLabel {
+		self.name = value
+		return
+	}
+	_, isTag := self.tags[name]
+	if _, isField := self.fields[name]; isField && !isTag {
+		if len(value) == 0 {
+			delete(self.fields, name)
+		} else {
+			self.fields[name] = StringValue(value)
+		}
+		return
+	}
+	if len(value) == 0 {
+		delete(self.tags, name)
+	} else {
+		self.tags[name] = value
+	}
+}
+
+// Moves a tag to a tag and a field to a field.
+func (self *labelSet) rename(from, to string) {
+	if from == nameLabel || to == nameLabel {
+		self.set(to, self.get(from))
+		return
+	}
+	if tag, ok := self.tags[from]; ok {
+		delete(self.tags, from)
+		self.tags[to] = tag
+	}
+	if field, ok := self.fields[from]; ok {
+		delete(self.fields, from)
+		self.fields[to] = field
+	}
+}
+
+func (self *labelSet) point(timestamp uint64) *Point {
+	return &Point{timestamp, self.tags, self.fields}
+}
+
+func (self *RelabelRule) apply(labels *labelSet) {
+	values := make([]string, len(self.Source))
+	for i, name := range self.Source {
+		values[i] = labels.get(name)
+	}
+	value := strings.Join(values, self.separator)
+
+	switch self.Action {
+	case "replace":
+		match := self.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return
+		}
+		result := self.regex.ExpandString(nil, self.replacement, value, match)
+		labels.set(self.Target, string(result))
+	case "lowercase":
+		labels.set(self.Target, strings.ToLower(value))
+	case "rename":
+		labels.rename(self.Source[0], self.Target)
+	}
+}
+
+// Applies rules to every point separately, then regroups the points by their
+// resulting metric name.
+func relabelMetrics(metrics []*Metric) []*Metric {
+	if len(relabelRules) == 0 {
+		return metrics
+	}
+
+	result := []*Metric{}
+	for _, metric := range metrics {
+		groups := make(map[string]*Metric)
+		for _, point := range metric.Points {
+			labels := pointLabels(metric.Name, point)
+			for _, rule := range relabelRules {
+				rule.apply(labels)
+			}
+
+			name := labels.get(nameLabel)
+			group, ok := groups[name]
+			if !ok {
+				group = NewMetric(name)
+				groups[name] = group
+				result = append(result, group)
+			}
+			group.Add(labels.point(point.Time))
+		}
+	}
+	return result
+}
+
+func handleRelabel(w http.ResponseWriter, req *http.Request) {
+	_, handled := handleApiKey(w, req)
+	if handled {
+		return
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	data := make(map[string]interface{})
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var metrics []*Metric
+	if _, ok := data["series"]; ok {
+		series := StatsdSeries{}
+		err = json.Unmarshal(body, &series)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		metrics = mapStatsd(series.Series, true)
+	} else {
+		if _, ok := data["internalHostname"].(string); !ok {
+			http.Error(w, "intake payload without internalHostname", 400)
+			return
+		}
+		delete(data, "events")
+		metrics = mapMetrics(data, true)
+	}
+	before, err := json.Marshal(encodeSeries(metrics, "ns"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"before": json.RawMessage(before),
+		"after":  encodeSeries(transformMetrics(metrics, true), "ns"),
+	})
+}
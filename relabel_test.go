@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Prints a value with pointers followed and map keys sorted, so that two
+// snapshots of the same state compare equal.
+func dumpValue(b *strings.Builder, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			b.WriteString("nil")
+			return
+		}
+		dumpValue(b, v.Elem())
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		b.WriteString("{")
+		for _, key := range keys {
+			fmt.Fprintf(b, "%v: ", key)
+			dumpValue(b, v.MapIndex(key))
+			b.WriteString(", ")
+		}
+		b.WriteString("}")
+	case reflect.Struct:
+		b.WriteString("{")
+		for i := 0; i < v.NumField(); i++ {
+			fmt.Fprintf(b, "%s: ", v.Type().Field(i).Name)
+			dumpValue(b, v.Field(i))
+			b.WriteString(", ")
+		}
+		b.WriteString("}")
+	default:
+		fmt.Fprint(b, v)
+	}
+}
+
+func dumpState() string {
+	b := &strings.Builder{}
+	for _, state := range []interface{}{
+		heartbeat.hosts, hostTags.hosts, inventory.hosts, inventory.dirty, serviceChecks.states,
+		agentChecks.results, processTracker.hosts, derivative.counters, cardinalityGuard.series,
+		fieldTypes.learned, len(eventsChan),
+	} {
+		dumpValue(b, reflect.ValueOf(state))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func TestRelabelPreviewLeavesStateAlone(t *testing.T) {
+	defer func(h *Heartbeat, i *Inventory, p *ProcessTracker, d *Derivative, c *CardinalityGuard, f *FieldTypes, e chan []byte) {
+		heartbeat, inventory, processTracker, derivative, cardinalityGuard, fieldTypes, eventsChan = h, i, p, d, c, f, e
+	}(heartbeat, inventory, processTracker, derivative, cardinalityGuard, fieldTypes, eventsChan)
+
+	var err error
+	resetMappingState()
+	heartbeat = NewHeartbeat(time.Hour)
+	inventory, err = NewInventory(filepath.Join(t.TempDir(), "hosts.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processTracker, err = NewProcessTracker("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	derivative, err = NewDerivative("system.net.bytes_rcvd", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cardinalityGuard, err = NewCardinalityGuard(20, 2, "drop", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fieldTypes, err = LoadFieldTypes("", "drop", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventsChan = make(chan []byte, 100)
+
+	body, err := ioutil.ReadFile("testdata/intake/agent-5.32-linux.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make(map[string]interface{})
+	json.Unmarshal(body, &data)
+	intakeMetrics(data, time.Now())
+	for len(eventsChan) > 0 {
+		<-eventsChan
+	}
+	before := dumpState()
+
+	// A later payload in which a service check recovers, a watched process
+	// exits, counters move on and new tag values and field types appear.
+	data = make(map[string]interface{})
+	json.Unmarshal(body, &data)
+	data["collection_timestamp"] = data["collection_timestamp"].(float64) + 60
+	for _, check := range data["service_checks"].([]interface{}) {
+		check := check.(map[string]interface{})
+		check["timestamp"] = check["timestamp"].(float64) + 60
+		check["status"] = 0.0
+	}
+	processes := data["processes"].(map[string]interface{})
+	processes["processes"] = processes["processes"].([]interface{})[:1]
+	for _, metric := range data["metrics"].([]interface{}) {
+		metric := metric.([]interface{})
+		metric[1] = metric[1].(float64) + 60
+		if metric[0] == "datadog.agent.emitter.emit.time" {
+			metric[2] = "slow"
+		} else {
+			metric[2] = metric[2].(float64) + 1000
+		}
+		attributes := metric[3].(map[string]interface{})
+		attributes["tags"] = []interface{}{"db:other", "service:other"}
+	}
+	body, err = json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range [][]byte{body, []byte(`{"series": [{"metric": "app.requests", "points": [[1560000070, 1]], "tags": ["env:new"], "host": "web-99", "type": "count", "interval": 10}]}`)} {
+		w := httptest.NewRecorder()
+		handleRelabel(w, httptest.NewRequest("POST", "/relabel", bytes.NewReader(payload)))
+		if w.Code != 200 {
+			t.Fatalf("relabel returned %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	if after := dumpState(); after != before {
+		t.Errorf("relabel changed the server state\nbefore: %s\nafter:  %s", before, after)
+	}
+}
+
+func TestRelabelKeepsTagsAndFieldsApart(t *testing.T) {
+	defer func(rules []*RelabelRule) { relabelRules = rules }(relabelRules)
+	path := filepath.Join(t.TempDir(), "relabel.json")
+	err := ioutil.WriteFile(path, []byte(`[
+		{"source": ["env"], "target": "environment"},
+		{"source": ["count"], "replacement": "n=$1", "target": "count"},
+		{"action": "rename", "source": ["rate"], "target": "per_second"}
+	]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relabelRules, err = loadRelabelRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metric := NewMetric("app.requests")
+	point := NewPoint(0, "web-01")
+	point.SetTag("value", "x")
+	point.SetTag("env", "prod")
+	point.SetField("value", 1.0)
+	point.SetField("count", 2.0)
+	point.SetField("rate", 3.0)
+	metric.Add(point)
+
+	result := relabelMetrics([]*Metric{metric})[0].Points[0]
+	if result.Tags["value"] != "x" || result.Tags["environment"] != "prod" {
+		t.Errorf("unexpected tags: %v", result.Tags)
+	}
+	if value := result.Fields["value"]; value.Type != FloatType || value.f != 1 {
+		t.Errorf("value field was replaced: %+v", result.Fields)
+	}
+	if count := result.Fields["count"]; count.Type != StringType || count.s != "n=2" {
+		t.Errorf("count field was not kept a field: %+v, tags %v", result.Fields, result.Tags)
+	}
+	if rate, ok := result.Fields["per_second"]; !ok || rate.f != 3 {
+		t.Errorf("renamed field is missing: %+v", result.Fields)
+	}
+}
+
+func TestRelabelRejectsIntakeWithoutHostname(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleRelabel(w, httptest.NewRequest("POST", "/relabel", strings.NewReader(`{"collection_timestamp": 1560000000}`)))
+	if w.Code != 400 {
+		t.Errorf("relabel returned %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Points that arrive this long after their window has ended are dropped.
+const rollupDelay = 30 * time.Second
+
+type RollupWindow struct {
+	Name     string
+	Duration time.Duration
+}
+
+type rollupStats struct {
+	min, max, sum float64
+	count         int
+}
+
+type rollupBucket struct {
+	window *RollupWindow
+	name   string
+	start  uint64
+	tags   map[string]string
+	fields map[string]*rollupStats
+}
+
+// Rollup keeps min/max/mean/sum/count of selected series over fixed windows,
+// and writes each window once it has closed to a series prefixed with the
+// window name, or to a separate database per window if Database is set.
+type Rollup struct {
+	sync.Mutex
+	Patterns  []*Pattern
+	Windows   []*RollupWindow
+	Database  string
+	Precision string
+
+	buckets map[string]*rollupBucket
+	flushed map[string]uint64
+	pending []*rollupBucket
+}
+
+var rollup *Rollup
+
+func NewRollup(patterns, windows, database, precision string) (*Rollup, error) {
+	if _, ok := influxPrecisions[precision]; !ok {
+		return nil, fmt.Errorf("unsupported rollup time precision: %q", precision)
+	}
+	self := &Rollup{
+		Database:  database,
+		Precision: precision,
+		buckets:   make(map[string]*rollupBucket),
+		flushed:   make(map[string]uint64),
+	}
+	for _, str := range strings.Split(patterns, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+		pattern, err := CompilePattern(str)
+		if err != nil {
+			return nil, err
+		}
+		self.Patterns = append(self.Patterns, pattern)
+	}
+	for _, str := range strings.Split(windows, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+		duration, err := time.ParseDuration(str)
+		if err != nil {
+			return nil, err
+		}
+		if duration <= 0 {
+			return nil, fmt.Errorf("rollup window must be positive: %q", str)
+		}
+		self.Windows = append(self.Windows, &RollupWindow{str, duration})
+	}
+	// Without the window in the database name every window would be written
+	// to the same series.
+	if len(database) > 0 && len(self.Windows) > 1 && !strings.Contains(database, "{window}") {
+		return nil, fmt.Errorf("rollup database %q needs {window} for more than one window", database)
+	}
+	return self, nil
+}
+
+func (self *Rollup) matches(name string) bool {
+	for _, pattern := range self.Patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Rollup) Add(metrics []*Metric) {
+	self.Lock()
+	defer self.Unlock()
+
+	cutoff := timeToTimestamp(time.Now().Add(-rollupDelay))
+	for _, metric := range metrics {
+		if !self.matches(metric.Name) {
+			continue
+		}
+		for _, point := range metric.Points {
+			timestamp := point.Time
+			series := point.SeriesKey(metric.Name)
+			for _, window := range self.Windows {
+				size := uint64(window.Duration)
+				start := timestamp - timestamp%size
+				key := window.Name + "|" + series
+				if start+size <= cutoff {
+					continue
+				}
+				if flushed, ok := self.flushed[key]; ok && start < flushed {
+					continue
+				}
+				bucket := self.buckets[key]
+				if bucket != nil && bucket.start != start {
+					if start < bucket.start {
+						continue
+					}
+					self.flush(key)
+					bucket = nil
+				}
+				if bucket == nil {
+					bucket = newRollupBucket(window, metric.Name, point, start)
+					self.buckets[key] = bucket
+				}
+				bucket.add(point)
+			}
+		}
+	}
+}
+
+func newRollupBucket(window *RollupWindow, name string, point *Point, start uint64) *rollupBucket {
+	tags := make(map[string]string, len(point.Tags))
+	for k, v := range point.Tags {
+		tags[k] = v
+	}
+	return &rollupBucket{window, name, start, tags, make(map[string]*rollupStats)}
+}
+
+func (self *rollupBucket) add(point *Point) {
+	for field, v := range point.Fields {
+		value, ok := v.Float()
+		if !ok {
+			continue
+		}
+		stats, ok := self.fields[field]
+		if !ok {
+			stats = &rollupStats{math.Inf(1), math.Inf(-1), 0, 0}
+			self.fields[field] = stats
+		}
+		stats.min = math.Min(stats.min, value)
+		stats.max = math.Max(stats.max, value)
+		stats.sum += value
+		stats.count++
+	}
+}
+
+func (self *rollupBucket) point() *Point {
+	point := NewPoint(self.start, "")
+	for k, v := range self.tags {
+		point.Tags[k] = v
+	}
+	for field, stats := range self.fields {
+		point.SetField(field+"_min", stats.min)
+		point.SetField(field+"_max", stats.max)
+		point.SetField(field+"_mean", stats.sum/float64(stats.count))
+		point.SetField(field+"_sum", stats.sum)
+		point.SetField(field+"_count", stats.count)
+	}
+	return point
+}
+
+// Must be called with the lock held.
+func (self *Rollup) flush(key string) {
+	bucket := self.buckets[key]
+	delete(self.buckets, key)
+	self.flushed[key] = bucket.start + uint64(bucket.window.Duration)
+	self.pending = append(self.pending, bucket)
+}
+
+// Flushes every window that ended before now and returns the resulting
+// metrics grouped by destination database.
+func (self *Rollup) Flush(now time.Time) map[string][]*Metric {
+	self.Lock()
+	defer self.Unlock()
+
+	cutoff := timeToTimestamp(now.Add(-rollupDelay))
+	for key, bucket := range self.buckets {
+		if bucket.start+uint64(bucket.window.Duration) <= cutoff {
+			self.flush(key)
+		}
+	}
+	for key, end := range self.flushed {
+		if end+uint64(rollupDelay) < cutoff {
+			if _, ok := self.buckets[key]; !ok {
+				delete(self.flushed, key)
+			}
+		}
+	}
+
+	groups := make(map[string]map[string][]*Point)
+	for _, bucket := range self.pending {
+		db := dbName
+		name := bucket.window.Name + "." + bucket.name
+		if len(self.Database) > 0 {
+			db = strings.Replace(self.Database, "{window}", bucket.window.Name, -1)
+			name = bucket.name
+		}
+		if groups[db] == nil {
+			groups[db] = make(map[string][]*Point)
+		}
+		groups[db][name] = append(groups[db][name], bucket.point())
+	}
+	self.pending = nil
+
+	result := make(map[string][]*Metric)
+	for db, series := range groups {
+		names := make([]string, 0, len(series))
+		for name := range series {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			result[db] = append(result[db], &Metric{name, series[name]})
+		}
+	}
+	return result
+}
+
+func (self *Rollup) Databases() []string {
+	if len(self.Database) == 0 {
+		return nil
+	}
+	dbs := make([]string, len(self.Windows))
+	for i, window := range self.Windows {
+		dbs[i] = strings.Replace(self.Database, "{window}", window.Name, -1)
+	}
+	return dbs
+}
+
+func (self *Rollup) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		for db, metrics := range self.Flush(now) {
+			log.Printf("Flushing %d rollup series to %s\n", len(metrics), db)
+			sink := &InfluxSink{db, self.Precision}
+			sink.Push(metrics)
+		}
+	}
+}
+
+func rollupMetrics(metrics []*Metric) {
+	if rollup != nil {
+		rollup.Add(metrics)
+	}
+}
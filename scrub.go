@@ -0,0 +1,91 @@
+package main
+
+import (
+	"regexp"
+	"unicode/utf8"
+)
+
+const scrubMask = "********"
+
+// The first capture group of each pattern is replaced with the mask, or the
+// whole match if the pattern has no groups.
+var builtinScrubPatterns = []string{
+	`(?i)--?(?:password|passwd|pwd|secret|token|api[-_]?key|access[-_]?key|auth)[= ](\S+)`,
+	`mysql\S*\s(?:.*\s)?-p(\S+)`,
+	`[a-zA-Z][a-zA-Z0-9+.-]*://[^:@/\s]+:([^@/\s]+)@`,
+	`\b[A-Z0-9_]*(?:SECRET|PASSWORD|PASSWD|TOKEN|API_KEY|ACCESS_KEY)[A-Z0-9_]*=(\S+)`,
+}
+
+var (
+	scrubPatterns    []*regexp.Regexp
+	commandMaxLength int
+)
+
+func compileScrubPatterns(extra []string) ([]*regexp.Regexp, error) {
+	patterns := []*regexp.Regexp{}
+	for _, expr := range append(append([]string{}, builtinScrubPatterns...), extra...) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+func loadScrubPatterns(path string) ([]*regexp.Regexp, error) {
+	extra := []string{}
+	if len(path) > 0 {
+		err := loadJSONConfig(path, &extra)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return compileScrubPatterns(extra)
+}
+
+func scrubString(re *regexp.Regexp, str string) string {
+	matches := re.FindAllStringSubmatchIndex(str, -1)
+	if matches == nil {
+		return str
+	}
+	result := ""
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		if len(match) > 2 && match[2] >= 0 {
+			start, end = match[2], match[3]
+		}
+		result += str[last:start] + scrubMask
+		last = end
+	}
+	return result + str[last:]
+}
+
+// Removes secrets from a process command line.
+func scrubCommand(command string) string {
+	for _, re := range scrubPatterns {
+		command = scrubString(re, command)
+	}
+	return command
+}
+
+const truncatedSuffix = "..."
+
+// Shortens a command to at most PS_COMMAND_MAX bytes, including the suffix
+// that marks it as truncated. Only done when writing, so that grouping and
+// family rules see the whole command.
+func truncateCommand(command string) string {
+	if commandMaxLength <= 0 || len(command) <= commandMaxLength {
+		return command
+	}
+	suffix := truncatedSuffix
+	if commandMaxLength <= len(suffix) {
+		suffix = ""
+	}
+	end := commandMaxLength - len(suffix)
+	for end > 0 && !utf8.RuneStart(command[end]) {
+		end--
+	}
+	return command[:end] + suffix
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sort"
+)
+
+// Series is a metric in the InfluxDB 0.8 JSON format, where tags and fields
+// are all columns and every point has a value, or nil, for each column.
+type Series struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Points  [][]interface{} `json:"points"`
+}
+
+// Tags and fields share one namespace in a series. A field named time or
+// hostname, or a tag named like a field, is written with a "_" prefix.
+func seriesColumns(metric *Metric) ([]string, map[string]int, map[string]int) {
+	tagSet := make(map[string]bool)
+	fieldSet := make(map[string]bool)
+	for _, point := range metric.Points {
+		for k := range point.Tags {
+			tagSet[k] = true
+		}
+		for k := range point.Fields {
+			fieldSet[k] = true
+		}
+	}
+
+	tags := make([]string, 0, len(tagSet))
+	for k := range tagSet {
+		if k != "hostname" {
+			tags = append(tags, k)
+		}
+	}
+	sort.Strings(tags)
+	if tagSet["hostname"] {
+		tags = append([]string{"hostname"}, tags...)
+	}
+	fields := make([]string, 0, len(fieldSet))
+	for k := range fieldSet {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+
+	columns := []string{"time"}
+	tagIndex := make(map[string]int)
+	fieldIndex := make(map[string]int)
+	for _, k := range tags {
+		tagIndex[k] = len(columns)
+		if k == "time" || (k != "hostname" && fieldSet[k]) {
+			columns = append(columns, "_"+k)
+		} else {
+			columns = append(columns, k)
+		}
+	}
+	for _, k := range fields {
+		fieldIndex[k] = len(columns)
+		if k == "time" || k == "hostname" {
+			columns = append(columns, "_"+k)
+		} else {
+			columns = append(columns, k)
+		}
+	}
+	return columns, tagIndex, fieldIndex
+}
+
+func EncodeSeries(metric *Metric, precision string) *Series {
+	columns, tagIndex, fieldIndex := seriesColumns(metric)
+	points := make([][]interface{}, len(metric.Points))
+	for i, point := range metric.Points {
+		row := make([]interface{}, len(columns))
+		row[0] = convertTimestamp(point.Time, precision)
+		for k, v := range point.Tags {
+			row[tagIndex[k]] = v
+		}
+		for k, v := range point.Fields {
+			row[fieldIndex[k]] = v.Interface()
+		}
+		points[i] = row
+	}
+	return &Series{metric.Name, columns, points}
+}
+
+func encodeSeries(metrics []*Metric, precision string) []*Series {
+	series := make([]*Series, len(metrics))
+	for i, metric := range metrics {
+		series[i] = EncodeSeries(metric, precision)
+	}
+	return series
+}
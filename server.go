@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
 	"encoding/json"
 	"fmt"
@@ -12,15 +13,14 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	listenAddr    string
 	eventLogPath  string
 	processFilter float64
-	authApiKey    string
 	dbUrl         string
-	seriesUrl     string
 	dbName        string
 
 	eventLog   *os.File
@@ -76,62 +76,46 @@ var processMetrics = []string{
 	"running_time",
 	"command",
 }
-var aggregateProcessMetrics = []string{
-	"user",
-	"pid",
-	"pct_cpu",
-	"pct_mem",
-	"vsz",
-	"rss",
-	"family",
-	"command",
-	"ps_count",
-}
-
-var diskMetrics = []string{
-	"device",
-	"total",
-	"used",
-	"free",
-	"in_use",
-	"mount",
-}
-
 var ioMetrics = []string{
 	"util",
 	"avg_q_sz",
 	"avg_rq_sz",
+	"r_avg_rq_sz",
+	"w_avg_rq_sz",
 	"await",
 	"r_s",
 	"r_await",
 	"rkb_s",
 	"rrqm_s",
+	"pct_rrqm",
 	"svctm",
 	"w_s",
 	"w_await",
 	"wkb_s",
 	"wrqm_s",
-}
-var ioMetricMapping = map[string]string{
-	"util":      "%util",
-	"avg_q_sz":  "avgqu-sz",
-	"avg_rq_sz": "avgrq-sz",
-	"await":     "await",
-	"r_s":       "r/s",
-	"r_await":   "r_await",
-	"rkb_s":     "rkB/s",
-	"rrqm_s":    "rrqm/s",
-	"svctm":     "svctm",
-	"w_s":       "w/s",
-	"w_await":   "w_await",
-	"wkb_s":     "wkB/s",
-	"wrqm_s":    "wrqm/s",
+	"pct_wrqm",
 }
 
-type Metric struct {
-	Name    string          `json:"name"`
-	Columns []string        `json:"columns"`
-	Points  [][]interface{} `json:"points"`
+// The ioStats keys of every column, as named by older and newer versions of
+// iostat. The first key that is present wins.
+var ioMetricMapping = map[string][]string{
+	"util":        {"%util"},
+	"avg_q_sz":    {"avgqu-sz", "aqu-sz"},
+	"avg_rq_sz":   {"avgrq-sz"},
+	"r_avg_rq_sz": {"rareq-sz"},
+	"w_avg_rq_sz": {"wareq-sz"},
+	"await":       {"await"},
+	"r_s":         {"r/s"},
+	"r_await":     {"r_await"},
+	"rkb_s":       {"rkB/s"},
+	"rrqm_s":      {"rrqm/s"},
+	"pct_rrqm":    {"%rrqm"},
+	"svctm":       {"svctm"},
+	"w_s":         {"w/s"},
+	"w_await":     {"w_await"},
+	"wkb_s":       {"wkB/s"},
+	"wrqm_s":      {"wrqm/s"},
+	"pct_wrqm":    {"%wrqm"},
 }
 
 type StatsdSeries struct {
@@ -139,64 +123,45 @@ type StatsdSeries struct {
 }
 
 type StatsdMetric struct {
-	Tags     []string        `json:"tags"`
-	Metric   string          `json:"metric"`
-	Interval float64         `json:"interval"`
-	Host     string          `json:"host"`
-	Points   [][]interface{} `json:"points"`
-	Type     string          `json:"type"`
+	Tags     []string       `json:"tags"`
+	Metric   string         `json:"metric"`
+	Interval float64        `json:"interval"`
+	Host     string         `json:"host"`
+	Points   []*StatsdPoint `json:"points"`
+	Type     string         `json:"type"`
 }
 
-func NewMetricGroup(host, name string, timestamp uint64, values map[string]interface{}, tags map[string]interface{}) *Metric {
-	columns := []string{"time", "hostname"}
-	points := [][]interface{}{{timestamp, host}}
-	if values != nil {
-		for k, v := range values {
-			if k == "time" || k == "hostname" {
-				columns = append(columns, "_"+k)
-			} else {
-				columns = append(columns, k)
-			}
-			points[0] = append(points[0], v)
-		}
-	}
+type StatsdPoint struct {
+	Timestamp float64
+	Value     float64
+}
 
-	if tags != nil {
-		for k, v := range tags {
-			if k == "hostname" {
-				points[0][1] = v
-			} else {
-				if k == "time" {
-					columns = append(columns, "_"+k)
-				} else {
-					columns = append(columns, k)
-				}
-				points[0] = append(points[0], v)
-			}
-		}
+func (self *StatsdPoint) UnmarshalJSON(data []byte) error {
+	var raw []float64
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	if len(raw) != 2 {
+		return fmt.Errorf("statsd point should be [timestamp, value]: %s", data)
 	}
-	return &Metric{name, columns, points}
+	self.Timestamp, self.Value = raw[0], raw[1]
+	return nil
 }
 
-func PushMetrics(metrics []*Metric) {
-	if len(metrics) == 0 {
-		return
+func NewMetricGroup(host, name string, timestamp uint64, values map[string]interface{}, tags map[string]interface{}) *Metric {
+	point := NewPoint(timestamp, host)
+	for k, v := range values {
+		point.SetField(k, v)
 	}
-	log.Printf("Pushing %d metrics to InfluxDB\n", len(metrics))
-
-	body, err := json.Marshal(metrics)
-	if err != nil {
-		log.Println(err)
-		return
+	for k, v := range tags {
+		point.SetTag(k, v)
 	}
+	return &Metric{name, []*Point{point}}
+}
 
-	resp, err := http.Post(seriesUrl, "application/json", bytes.NewBuffer(body))
-	if err != nil {
-		log.Println(err)
-	} else if resp.StatusCode != 200 {
-		dump, _ := httputil.DumpResponse(resp, true)
-		log.Printf("Got Response: %s\n%s\n\n\n%s", resp.Status, string(body), string(dump))
-	}
+func PushMetrics(metrics []*Metric) {
+	mainSink.Push(metrics)
 }
 
 func GroupMetric(name string) (string, string) {
@@ -208,7 +173,9 @@ func GroupMetric(name string) (string, string) {
 	}
 }
 
-func mapStatsd(series []*StatsdMetric) []*Metric {
+// When preview is set the mappers leave host, check and cardinality state
+// untouched, so that a payload can be shown without affecting the server.
+func mapStatsd(series []*StatsdMetric, preview bool) []*Metric {
 	metrics := make([]*Metric, len(series))
 	host := ""
 
@@ -217,68 +184,83 @@ func mapStatsd(series []*StatsdMetric) []*Metric {
 			host = metric.Host
 		}
 
-		columns := []string{"time", "value", "hostname"}
-		points := metric.Points
-		for i, _ := range points {
-			points[i][0] = uint64(points[i][0].(float64) * 1000)
-			points[i] = append(points[i], host)
-		}
-
-		columns = append(columns, "metric_interval", "metric_type")
-		for i, _ := range points {
-			points[i] = append(points[i], metric.Interval, metric.Type)
+		name := "statsd." + metric.Metric
+		tags := make(map[string]string)
+		for _, tag := range metric.Tags {
+			split := strings.SplitN(tag, ":", 2)
+			if len(split) < 2 {
+				split = append(split, "")
+			}
+			if split[0] == "hostname" {
+				tags["hostname"] = split[1]
+			} else if value, ok := guardTag(name, split[0], split[1], preview); ok {
+				tags[split[0]] = value
+			}
 		}
 
-		if metric.Tags != nil {
-			for _, tag := range metric.Tags {
-				split := strings.SplitN(tag, ":", 2)
-				if split[0] == "hostname" {
-					for i, _ := range points {
-						points[i][2] = split[1]
-					}
-				} else {
-					if split[0] == "time" || split[0] == "value" {
-						columns = append(columns, "_"+split[0])
-					} else {
-						columns = append(columns, split[0])
-					}
-					for i, _ := range points {
-						points[i] = append(points[i], split[1])
-					}
-				}
+		mode := statsdTypeMode(metric.Type)
+		points := make([]*Point, len(metric.Points))
+		for j, raw := range metric.Points {
+			point := NewPoint(agentTimestamp(raw.Timestamp), host)
+			value, perInterval := normalizeStatsdValue(metric.Type, mode, metric.Interval, raw.Value)
+			point.SetField("value", value)
+			if mode == "both" {
+				point.SetField("value_per_interval", perInterval)
 			}
+			point.SetField("metric_interval", metric.Interval)
+			point.SetTag("metric_type", metric.Type)
+			for k, v := range tags {
+				point.Tags[k] = v
+			}
+			points[j] = point
 		}
-		metrics[i] = &Metric{"statsd." + metric.Metric, columns, points}
+		metrics[i] = &Metric{name, points}
 	}
 
 	log.Printf("Parsed statsd for: %s\n", host)
 
+	hosts := make(map[string]bool)
 	for _, metric := range metrics {
-		for _, points := range metric.Points {
-			if len(points[2].(string)) == 0 {
-				points[2] = host
+		for _, point := range metric.Points {
+			if len(point.Host()) == 0 {
+				point.SetTag("hostname", host)
 			}
+			hosts[point.Host()] = true
+		}
+	}
+	if !preview {
+		for host := range hosts {
+			touchHost(host)
 		}
 	}
 
 	return metrics
 }
 
-func mapMetrics(data map[string]interface{}) []*Metric {
+func mapMetrics(data map[string]interface{}, preview bool) []*Metric {
 	host := data["internalHostname"].(string)
 	log.Printf("Parsing metrics for: %s\n", host)
 
 	delete(data, "apiKey")
 	delete(data, "internalHostname")
+	if !preview {
+		touchHost(host)
+		hostTags.Update(host, data)
+		if inventory != nil {
+			inventory.Update(host, data)
+		}
+	}
 
 	if data["events"] != nil {
-		parseEvents(data["events"].(map[string]interface{}))
+		if !preview {
+			parseEvents(data["events"].(map[string]interface{}))
+		}
 		delete(data, "events")
 	}
 
 	metrics := []*Metric{}
 	if data["collection_timestamp"] != nil {
-		timestamp := uint64(data["collection_timestamp"].(float64) * 1000)
+		timestamp := agentTimestamp(data["collection_timestamp"].(float64))
 		delete(data, "collection_timestamp")
 
 		metrics = append(metrics, mapMetadata(host, timestamp, data)...)
@@ -303,12 +285,19 @@ func mapMetrics(data map[string]interface{}) []*Metric {
 
 		agentChecks, ok := data["agent_checks"]
 		if ok {
-			metrics = append(metrics, mapAgentChecks(host, timestamp, agentChecks.([]interface{}))...)
+			metrics = append(metrics, mapAgentChecks(host, timestamp, agentChecks.([]interface{}), preview)...)
 			delete(data, "agent_checks")
 		}
 
 		if data["processes"] != nil {
-			metrics = append(metrics, mapProcesses(timestamp, data["processes"].(map[string]interface{})))
+			processes := data["processes"].(map[string]interface{})
+			metrics = append(metrics, mapProcesses(timestamp, processes))
+			if processTracker != nil && !preview {
+				watched := processTracker.Update(processes["host"].(string), timestamp, processes["processes"].([]interface{}))
+				if watched != nil {
+					metrics = append(metrics, watched)
+				}
+			}
 			delete(data, "processes")
 		}
 		delete(data, "resources") // Only ever contains process data that is already collected above
@@ -325,21 +314,24 @@ func mapMetrics(data map[string]interface{}) []*Metric {
 			delete(data, "ioStats")
 		}
 	} else {
+		// Agent 6 and later send host metadata in its own payload, without a
+		// collection timestamp.
+		metrics = append(metrics, mapMetadata(host, metadataTimestamp(data), data)...)
 		delete(data, "uuid")
 	}
 	if data["service_checks"] != nil {
-		metrics = append(metrics, mapServiceChecks(data["service_checks"].([]interface{}))...)
+		metrics = append(metrics, mapServiceChecks(data["service_checks"].([]interface{}), preview)...)
 		delete(data, "service_checks")
 	}
 	if data["metrics"] != nil {
-		metrics = append(metrics, mapExtraMetrics(host, data["metrics"].([]interface{}))...)
+		metrics = append(metrics, mapExtraMetrics(host, data["metrics"].([]interface{}), preview)...)
 		delete(data, "metrics")
 	}
 
 	if len(data) > 0 {
 		debug, err := json.MarshalIndent(data, "", "  ")
 		if err == nil {
-			fmt.Println("Unprocessed metrics:", string(debug))
+			log.Println("Unprocessed metrics:", string(debug))
 		}
 	}
 	return metrics
@@ -354,47 +346,45 @@ func mapMetadata(host string, timestamp uint64, data map[string]interface{}) []*
 	}
 
 	if data["host-tags"] != nil {
-		hostTags := data["host-tags"].(map[string]interface{})
-		for k, v := range hostTags {
-			tmp := v.([]interface{})
-			tags := make([]string, len(tmp))
-			for i, tag := range tmp {
-				tags[i] = tag.(string)
-			}
-			hostTags[k] = strings.Join(tags, ",")
-		}
-		if len(hostTags) > 0 {
-			metrics = append(metrics, NewMetricGroup(host, "host.meta.tags", timestamp, nil, hostTags))
+		if hostTags, ok := data["host-tags"].(map[string]interface{}); ok && len(hostTags) > 0 {
+			metrics = append(metrics, NewMetricGroup(host, "host.meta.tags", timestamp, nil, joinTagLists(hostTags)))
 		}
 		delete(data, "host-tags")
 	}
 
-	if data["external_host_tags"] != nil {
-		hostTags := data["external_host_tags"].(map[string]interface{})
-		for k, v := range hostTags {
-			tmp := v.([]interface{})
-			tags := make([]string, len(tmp))
-			for i, tag := range tmp {
-				tags[i] = tag.(string)
-			}
-			hostTags[k] = strings.Join(tags, ",")
+	// Like in HostTagCache.Update, external_host_tags is either a map of
+	// source to tags for this host, or a list of [hostname, {source: tags}].
+	switch external := data["external_host_tags"].(type) {
+	case map[string]interface{}:
+		if len(external) > 0 {
+			metrics = append(metrics, NewMetricGroup(host, "host.meta.tags.external", timestamp, nil, joinTagLists(external)))
 		}
-		if len(hostTags) > 0 {
-			metrics = append(metrics, NewMetricGroup(host, "host.meta.tags.external", timestamp, nil, hostTags))
+	case []interface{}:
+		for _, tmp := range external {
+			entry, ok := tmp.([]interface{})
+			if !ok || len(entry) != 2 {
+				continue
+			}
+			name, _ := entry[0].(string)
+			tags, _ := entry[1].(map[string]interface{})
+			if len(name) > 0 && len(tags) > 0 {
+				metrics = append(metrics, NewMetricGroup(name, "host.meta.tags.external", timestamp, nil, joinTagLists(tags)))
+			}
 		}
-		delete(data, "external_host_tags")
 	}
+	delete(data, "external_host_tags")
 
 	if data["systemStats"] != nil {
 		systemStats := data["systemStats"].(map[string]interface{})
 		for k, v := range systemStats {
 			tmp, ok := v.([]interface{})
 			if ok {
-				parts := make([]string, len(tmp))
-				for i, part := range tmp {
-					parts[i] = part.(string)
+				version := strings.Join(versionParts(tmp), "-")
+				if len(version) > 0 {
+					systemStats[k] = version
+				} else {
+					delete(systemStats, k)
 				}
-				systemStats[k] = strings.Join(parts, "-")
 			}
 		}
 		metrics = append(metrics, NewMetricGroup(host, "host.meta.stats", timestamp, systemStats, nil))
@@ -404,6 +394,54 @@ func mapMetadata(host string, timestamp uint64, data map[string]interface{}) []*
 	return metrics
 }
 
+// Joins the tag lists of every source with commas.
+func joinTagLists(sources map[string]interface{}) map[string]interface{} {
+	joined := make(map[string]interface{}, len(sources))
+	for source, tags := range sources {
+		joined[source] = strings.Join(toStringSlice(tags), ",")
+	}
+	return joined
+}
+
+// Flattens a platform version tuple, leaving out empty entries. macV holds a
+// nested tuple on OS X, and the tuples of other platforms are all empty.
+func versionParts(tuple []interface{}) []string {
+	parts := []string{}
+	for _, part := range tuple {
+		switch v := part.(type) {
+		case []interface{}:
+			parts = append(parts, versionParts(v)...)
+		case nil:
+		default:
+			if str := tagString(v); len(str) > 0 {
+				parts = append(parts, str)
+			}
+		}
+	}
+	return parts
+}
+
+// Metadata payloads carry no timestamp of their own, so the latest process
+// snapshot that comes with them is used, or failing that the current time.
+func metadataTimestamp(data map[string]interface{}) uint64 {
+	latest := 0.0
+	resources, _ := data["resources"].(map[string]interface{})
+	processes, _ := resources["processes"].(map[string]interface{})
+	snaps, _ := processes["snaps"].([]interface{})
+	for _, snap := range snaps {
+		fields, _ := snap.([]interface{})
+		if len(fields) > 0 {
+			if timestamp, ok := fields[0].(float64); ok && timestamp > latest {
+				latest = timestamp
+			}
+		}
+	}
+	if latest > 0 {
+		return agentTimestamp(latest)
+	}
+	return timeToTimestamp(time.Now())
+}
+
 func addTagsArrayToMap(dest map[string]interface{}, src []interface{}) {
 	for _, tag := range src {
 		split := strings.SplitN(tag.(string), ":", 2)
@@ -411,17 +449,35 @@ func addTagsArrayToMap(dest map[string]interface{}, src []interface{}) {
 	}
 }
 
-func mapServiceChecks(data []interface{}) []*Metric {
+func mapServiceChecks(data []interface{}, preview bool) []*Metric {
 	metrics := []*Metric{}
+	changes := NewMetric("events.service_check")
 	for _, check := range data {
 		values := check.(map[string]interface{})
 		host := values["host_name"].(string)
 		name := "service." + values["check"].(string)
-		timestamp := uint64(values["timestamp"].(float64) * 1000)
+		timestamp := agentTimestamp(values["timestamp"].(float64))
+
+		status, _ := values["status"].(float64)
+		message, _ := values["message"].(string)
+		rawTags := []string{}
+		if values["tags"] != nil {
+			for _, tag := range values["tags"].([]interface{}) {
+				rawTags = append(rawTags, tag.(string))
+			}
+		}
+		if !preview {
+			change := serviceChecks.Update(host, values["check"].(string), rawTags, int(status), message, values["timestamp"].(float64))
+			if change != nil {
+				changes.Add(change)
+			}
+		}
+
 		var tags map[string]interface{}
 		if values["tags"] != nil {
 			tags = make(map[string]interface{})
 			addTagsArrayToMap(tags, values["tags"].([]interface{}))
+			guardTags(name, tags, preview)
 		}
 		delete(values, "check")
 		delete(values, "tags")
@@ -429,76 +485,100 @@ func mapServiceChecks(data []interface{}) []*Metric {
 		delete(values, "timestamp")
 		metrics = append(metrics, NewMetricGroup(host, name, timestamp, values, tags))
 	}
+	if len(changes.Points) > 0 {
+		metrics = append(metrics, changes)
+	}
 	return metrics
 }
 
-func mapAgentChecks(host string, timestamp uint64, data []interface{}) []*Metric {
+func mapAgentChecks(host string, timestamp uint64, data []interface{}, preview bool) []*Metric {
 	metrics := []*Metric{}
 	for _, check := range data {
 		values := check.([]interface{})
-		name := "check."
-		if values[1] == nil {
-			name += values[0].(string)
-		} else {
-			name += values[1].(string) + "." + values[0].(string)
+		name := values[0].(string)
+		if values[1] != nil {
+			name = values[1].(string) + "." + name
 		}
 		new_values := make(map[string]interface{})
 		new_values["instance_id"] = values[2]
 		new_values["status"] = values[3]
-		message := ""
-		messages, ok := values[4].([]interface{})
-		if ok {
-			for _, msg := range messages {
-				if len(message) > 0 {
-					message += "\n"
-				}
-				message += msg.(string)
-			}
-		} else {
-			message = values[4].(string)
-		}
+		message := joinCheckMessage(values[4])
 		new_values["message"] = message
-		metrics = append(metrics, NewMetricGroup(host, name, timestamp, new_values, nil))
+		metrics = append(metrics, NewMetricGroup(host, "check."+name, timestamp, new_values, nil))
+
+		if preview {
+			continue
+		}
+		status, _ := values[3].(string)
+		agentChecks.Update(&AgentCheckResult{host, name, values[2], status, message, timestampToTime(timestamp)})
 	}
 	return metrics
 }
 
 func mapDiskMetrics(name string, host string, timestamp uint64, data []interface{}) *Metric {
-	columns := append([]string{"time", "hostname"}, diskMetrics...)
-	points := make([][]interface{}, len(data))
-
-	for i, disk := range data {
+	rows := []map[string]interface{}{}
+	for _, disk := range data {
 		fields := disk.([]interface{})
+		layout := detectDiskLayout(fields)
+		if layout == nil {
+			log.Printf("Unknown %s layout from %s: %v\n", name, host, fields)
+			continue
+		}
 
-		percent := fields[4].(string)
-		parse, _ := strconv.ParseFloat(percent[:len(percent)-1], 64)
-		fields[4] = parse / 100.0
-
-		points[i] = append([]interface{}{timestamp, host}, fields...)
+		row := make(map[string]interface{})
+		for i, column := range layout.Columns {
+			value := fields[i]
+			if diskNumericColumns[column] {
+				value = parseNumber(value)
+			} else if diskPercentColumns[column] {
+				value = parsePercent(value)
+			}
+			row[column] = value
+		}
+		if diskFilter.KeepRow(row) {
+			rows = append(rows, row)
+		}
+	}
+	rows = diskFilter.DedupeRows(rows)
+
+	metric := NewMetric(name)
+	for _, row := range rows {
+		point := NewPoint(timestamp, host)
+		for column, value := range row {
+			if diskTagColumns[column] {
+				point.SetTag(column, value)
+			} else {
+				point.SetField(column, value)
+			}
+		}
+		metric.Add(point)
 	}
-
-	metric := &Metric{name, columns, points}
 	return metric
 }
 
 func mapIOMetrics(host string, timestamp uint64, data map[string]interface{}) *Metric {
-	columns := append([]string{"time", "hostname", "device"}, ioMetrics...)
-	points := [][]interface{}{}
+	extraColumns, extraKeys := extraIOColumns(data)
+	metric := NewMetric("system.io")
 
 	for device, disk := range data {
+		if !diskFilter.KeepDevice(device) {
+			continue
+		}
 		fields := disk.(map[string]interface{})
 
-		values := make([]interface{}, len(ioMetrics))
-		for i, name := range ioMetrics {
-			value := fields[ioMetricMapping[name]]
-			parse, _ := strconv.ParseFloat(value.(string), 64)
-			values[i] = parse
+		point := NewPoint(timestamp, host)
+		point.SetTag("device", device)
+		for _, name := range ioMetrics {
+			point.SetField(name, ioValue(fields, ioMetricMapping[name]))
 		}
-
-		points = append(points, append([]interface{}{timestamp, host, device}, values...))
+		if _, ok := point.Fields["avg_rq_sz"]; !ok {
+			point.SetField("avg_rq_sz", averageRequestSize(fields))
+		}
+		for _, name := range extraColumns {
+			point.SetField(name, parseNumber(fields[extraKeys[name]]))
+		}
+		metric.Add(point)
 	}
-
-	metric := &Metric{"system.io", columns, points}
 	return metric
 }
 
@@ -515,44 +595,46 @@ func GetProcessFamily(command string) string {
 func mapProcesses(timestamp uint64, data map[string]interface{}) *Metric {
 	host := data["host"].(string)
 	processes := data["processes"].([]interface{})
-	aggregate := make(map[string][]interface{})
+	aggregate := make(map[string]*processGroup)
+	order := []string{}
 	for _, process := range processes {
 		fields := process.([]interface{})
-		family := "kernel"
-		aggr := "kernel"
+		user := fields[0].(string)
+		command := scrubCommand(fields[10].(string))
+		family := processFamily(command)
 
-		command := fields[10].(string)
-		if len(command) == 0 || command[0] != '[' {
-			family = GetProcessFamily(command)
-			aggr = command
-		}
-
-		result, ok := aggregate[aggr]
+		aggr := processGroupKey(user, family, command)
+		group, ok := aggregate[aggr]
 		if !ok {
-			result = make([]interface{}, len(aggregateProcessMetrics))
-			result[8] = 0
-			aggregate[aggr] = result
+			group = &processGroup{user: user, family: family, command: command}
+			group.pid, _ = strconv.ParseInt(fields[1].(string), 10, 64)
+			aggregate[aggr] = group
+			order = append(order, aggr)
 		}
 
-		result[0] = fields[0].(string)
-		result[1], _ = strconv.ParseInt(fields[1].(string), 10, 64)
-		result[2], _ = strconv.ParseFloat(fields[2].(string), 64)
-		result[3], _ = strconv.ParseFloat(fields[3].(string), 64)
-		result[4], _ = strconv.ParseInt(fields[4].(string), 10, 64)
-		result[5], _ = strconv.ParseInt(fields[5].(string), 10, 64)
-		result[6] = family
-		result[7] = command
-		result[8] = result[8].(int) + 1
+		pctCpu, _ := strconv.ParseFloat(fields[2].(string), 64)
+		pctMem, _ := strconv.ParseFloat(fields[3].(string), 64)
+		vsz, _ := strconv.ParseInt(fields[4].(string), 10, 64)
+		rss, _ := strconv.ParseInt(fields[5].(string), 10, 64)
+		group.pctCpu += pctCpu
+		group.pctMem += pctMem
+		group.vsz += vsz
+		group.rss += rss
+		group.count++
 	}
 
-	columns := append([]string{"time", "hostname"}, aggregateProcessMetrics...)
-	points := [][]interface{}{}
-	for _, process := range aggregate {
-		if process[2].(float64) >= processFilter || process[3].(float64) >= processFilter {
-			points = append(points, append([]interface{}{timestamp, host}, process...))
+	filtered := []*processGroup{}
+	for _, aggr := range order {
+		group := aggregate[aggr]
+		if group.pctCpu >= processFilter || group.pctMem >= processFilter {
+			filtered = append(filtered, group)
 		}
 	}
-	metric := &Metric{"processes", columns, points}
+
+	metric := NewMetric("processes")
+	for _, group := range topProcesses(filtered, processTopN) {
+		metric.Add(group.Point(timestamp, host))
+	}
 	return metric
 }
 
@@ -562,39 +644,20 @@ type ExtraMetric struct {
 	Timestamp uint64
 }
 
-func (self *ExtraMetric) ToMetric(host, name string) *Metric {
-	columns := []string{"time", "value", "hostname"}
-	points := make([][]interface{}, len(self.Values))
+func (self *ExtraMetric) ToMetric(host, name string, preview bool) *Metric {
+	metric := NewMetric(name)
 	for i, value := range self.Values {
-		points[i] = []interface{}{self.Timestamp, value, host}
-	}
-
-	for i, tags := range self.Tags {
-		for k, v := range tags {
-			if k == "time" || k == "value" {
-				k = "_" + k
-			}
-			found := false
-			for j, column := range columns {
-				if column == k {
-					points[i][j] = v
-					found = true
-					break
-				}
-			}
-			if !found {
-				columns = append(columns, k)
-				for j, _ := range points {
-					if j == i {
-						points[j] = append(points[j], v)
-					} else {
-						points[j] = append(points[j], nil)
-					}
-				}
+		point := NewPoint(self.Timestamp, host)
+		point.SetField("value", value)
+		for k, v := range self.Tags[i] {
+			tag, ok := guardTag(name, k, tagString(v), preview)
+			if ok {
+				point.Tags[k] = tag
 			}
 		}
+		metric.Add(point)
 	}
-	return &Metric{name, columns, points}
+	return metric
 }
 
 func addToExtraMetric(metric *ExtraMetric, value interface{}, tags map[string]interface{}) {
@@ -608,13 +671,13 @@ func addToExtraMetric(metric *ExtraMetric, value interface{}, tags map[string]in
 	metric.Tags = append(metric.Tags, tags)
 }
 
-func mapExtraMetrics(host string, data []interface{}) []*Metric {
+func mapExtraMetrics(host string, data []interface{}, preview bool) []*Metric {
 	groups := make(map[string]map[string]*ExtraMetric)
 
 	for _, tmp := range data {
 		metric := tmp.([]interface{})
 		name := metric[0].(string)
-		timestamp := uint64(metric[1].(float64) * 1000)
+		timestamp := agentTimestamp(metric[1].(float64))
 
 		group_name, field_name := GroupMetric(name)
 		group, ok := groups[group_name]
@@ -637,7 +700,7 @@ func mapExtraMetrics(host string, data []interface{}) []*Metric {
 		var groupTimestamp uint64
 		for field_name, extraMetric := range group {
 			if len(extraMetric.Values) > 1 {
-				metrics = append(metrics, extraMetric.ToMetric(host, group_name+"."+field_name))
+				metrics = append(metrics, extraMetric.ToMetric(host, group_name+"."+field_name, preview))
 			} else {
 				groupValues[field_name] = extraMetric.Values[0]
 				for k, v := range extraMetric.Tags[0] {
@@ -647,6 +710,7 @@ func mapExtraMetrics(host string, data []interface{}) []*Metric {
 			}
 		}
 		if len(groupValues) > 0 {
+			guardTags(group_name, groupTags, preview)
 			metrics = append(metrics, NewMetricGroup(host, group_name, groupTimestamp, groupValues, groupTags))
 		}
 	}
@@ -659,34 +723,113 @@ func parseEvents(data map[string]interface{}) {
 		for _, tmp2 := range events {
 			event := tmp2.(map[string]interface{})
 			event["source"] = source
-
-			buf, err := json.Marshal(event)
-			if err != nil {
-				log.Println("Failed to marshal event:", err)
-				continue
-			}
-			eventsChan <- buf
+			emitEvent(event)
 		}
 	}
 }
 
-func handleIntake(w http.ResponseWriter, req *http.Request) {
-	if handleApiKey(w, req) {
+// Events are dropped when there is no event log, e.g. during a replay.
+func emitEvent(event map[string]interface{}) {
+	if eventsChan == nil {
+		return
+	}
+	buf, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Failed to marshal event:", err)
 		return
 	}
+	eventsChan <- buf
+}
+
+func decompress(body io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "deflate":
+		return zlib.NewReader(body)
+	case "gzip":
+		return gzip.NewReader(body)
+	}
+	return body, nil
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	body, err := decompress(req.Body, req.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer([]byte{})
+	_, err = io.Copy(buf, body)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func transformMetrics(metrics []*Metric, preview bool) []*Metric {
+	metrics = enrichMetrics(metrics)
+	metrics = filterMetrics(metrics)
+	metrics = deriveMetrics(metrics, preview)
+	metrics = relabelMetrics(metrics)
+	metrics = enforceFieldTypes(metrics, preview)
+	return metrics
+}
+
+// intakeMetrics and seriesMetrics run a decoded payload through the mapping
+// and transform pipeline. received is when the payload reached dd-house.
+func intakeMetrics(data map[string]interface{}, received time.Time) []*Metric {
+	host, _ := data["internalHostname"].(string)
+	payload := uint64(0)
+	if timestamp, ok := data["collection_timestamp"].(float64); ok {
+		payload = agentTimestamp(timestamp)
+	}
+	metrics := correctSkew(mapMetrics(data, false), host, payload, received)
+	return transformMetrics(metrics, false)
+}
+
+func seriesMetrics(series *StatsdSeries, received time.Time) []*Metric {
+	metrics := mapStatsd(series.Series, false)
+	metrics = correctSkew(metrics, seriesHost(series), latestTimestamp(metrics), received)
+	return transformMetrics(metrics, false)
+}
 
-	body := req.Body
-	if req.Header.Get("Content-Encoding") == "deflate" {
-		var err error
-		body, err = zlib.NewReader(body)
+// payloadMetrics decodes the body of a request to path and runs it through
+// the pipeline, the same way the handlers do.
+func payloadMetrics(path string, body []byte, received time.Time) ([]*Metric, error) {
+	switch path {
+	case "/intake":
+		data := make(map[string]interface{})
+		err := json.Unmarshal(body, &data)
 		if err != nil {
-			log.Println(err)
-			io.WriteString(w, `{"status":"failed"}`)
-			return
+			return nil, err
+		}
+		return intakeMetrics(data, received), nil
+	case "/api/v1/series/":
+		series := StatsdSeries{}
+		err := json.Unmarshal(body, &series)
+		if err != nil {
+			return nil, err
 		}
+		return seriesMetrics(&series, received), nil
 	}
-	buf := bytes.NewBuffer([]byte{})
-	_, err := io.Copy(buf, body)
+	return nil, fmt.Errorf("unknown payload path: %q", path)
+}
+
+func seriesHost(series *StatsdSeries) string {
+	for _, metric := range series.Series {
+		if len(metric.Host) > 0 {
+			return metric.Host
+		}
+	}
+	return ""
+}
+
+func handleIntake(w http.ResponseWriter, req *http.Request) {
+	received := time.Now()
+	key, handled := handleApiKey(w, req)
+	if handled {
+		return
+	}
+
+	body, err := readBody(req)
 	if err != nil {
 		log.Println(err)
 		io.WriteString(w, `{"status":"failed"}`)
@@ -694,14 +837,23 @@ func handleIntake(w http.ResponseWriter, req *http.Request) {
 	}
 
 	data := make(map[string]interface{})
-	err = json.Unmarshal(buf.Bytes(), &data)
+	err = json.Unmarshal(body, &data)
 	if err != nil {
 		log.Println(err)
 		io.WriteString(w, `{"status":"failed"}`)
 		return
 	}
 
-	metrics := mapMetrics(data)
+	host, _ := data["internalHostname"].(string)
+	capturePayload(req, host, body, received)
+	if handleRateLimit(w, key, host, 1, intakePoints(data), len(body)) {
+		return
+	}
+
+	metrics := intakeMetrics(data, received)
+	rollupMetrics(metrics)
+	aggregateMetrics(metrics)
+	evaluateAlerts(metrics)
 	go PushMetrics(metrics)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -709,22 +861,13 @@ func handleIntake(w http.ResponseWriter, req *http.Request) {
 }
 
 func handleApi(w http.ResponseWriter, req *http.Request) {
-	if handleApiKey(w, req) {
+	received := time.Now()
+	key, handled := handleApiKey(w, req)
+	if handled {
 		return
 	}
 
-	body := req.Body
-	if req.Header.Get("Content-Encoding") == "deflate" {
-		var err error
-		body, err = zlib.NewReader(body)
-		if err != nil {
-			log.Println(err)
-			io.WriteString(w, `{"status":"failed"}`)
-			return
-		}
-	}
-	buf := bytes.NewBuffer([]byte{})
-	_, err := io.Copy(buf, body)
+	body, err := readBody(req)
 	if err != nil {
 		log.Println(err)
 		io.WriteString(w, `{"status":"failed"}`)
@@ -732,40 +875,62 @@ func handleApi(w http.ResponseWriter, req *http.Request) {
 	}
 
 	series := StatsdSeries{}
-	err = json.Unmarshal(buf.Bytes(), &series)
+	err = json.Unmarshal(body, &series)
 	if err != nil {
 		log.Println(err)
 		io.WriteString(w, `{"status":"failed"}`)
 		return
 	}
 
-	metrics := mapStatsd(series.Series)
+	host := seriesHost(&series)
+	capturePayload(req, host, body, received)
+	if handleRateLimit(w, key, host, 1, seriesPoints(&series), len(body)) {
+		return
+	}
+
+	metrics := seriesMetrics(&series, received)
+	rollupMetrics(metrics)
+	aggregateMetrics(metrics)
+	evaluateAlerts(metrics)
 	go PushMetrics(metrics)
 
 	w.Header().Set("Content-Type", "application/json")
 	io.WriteString(w, `{"status":"ok"}`)
 }
 
-func handleApiKey(w http.ResponseWriter, req *http.Request) bool {
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(buf, '\n'))
+}
+
+func handleApiKey(w http.ResponseWriter, req *http.Request) (string, bool) {
 	if req.UserAgent() == "Datadog-Status-Check" {
 		io.WriteString(w, "STILL-ALIVE\n")
-		return true
+		return "", true
 	}
 	err := req.ParseForm()
 	if err != nil {
 		log.Println("Error parsing form:", err)
 		http.Error(w, err.Error(), 500)
-		return true
+		return "", true
 	}
 	values := req.Form
 	api_key := values.Get("api_key")
 	delete(values, "api_key")
-	if len(authApiKey) > 0 && api_key != authApiKey {
-		log.Println("Got bad API key:", api_key)
-		http.Error(w, "Bad API Key", 403)
-		return true
+	if len(apiKeys) > 0 {
+		if _, ok := apiKeys[api_key]; !ok {
+			log.Println("Got bad API key:", api_key)
+			http.Error(w, "Bad API Key", 403)
+			return "", true
+		}
 	}
-	return false
+	return api_key, false
 }
 
 func writeEvents() {
@@ -781,8 +946,27 @@ func writeEvents() {
 	}
 }
 
-func CreateDBIfNotExists() error {
-	log.Println("Checking if DB exists:", dbName)
+func loadJSONConfig(path string, v interface{}) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+func SeriesUrl(db string) string {
+	split := strings.SplitN(dbUrl, "?", 2)
+	return split[0] + "/" + db + "/series?" + split[1]
+}
+
+func CreateDBIfNotExists(name string) error {
+	log.Println("Checking if DB exists:", name)
 
 	resp, err := http.Get(dbUrl)
 	if err != nil {
@@ -801,14 +985,14 @@ func CreateDBIfNotExists() error {
 	}
 
 	for _, db := range response {
-		if db["name"] == dbName {
+		if db["name"] == name {
 			return nil
 		}
 	}
 
-	log.Printf("Creating DB: %s\n", dbName)
+	log.Printf("Creating DB: %s\n", name)
 
-	body, err := json.Marshal(map[string]string{"name": dbName})
+	body, err := json.Marshal(map[string]string{"name": name})
 	if err != nil {
 		return err
 	}
@@ -824,58 +1008,375 @@ func CreateDBIfNotExists() error {
 	return nil
 }
 
-func main() {
-	listenAddr = os.Getenv("ADDR")
-	if len(listenAddr) == 0 {
-		listenAddr = ":8080"
-	}
-	eventLogPath = os.Getenv("EVENT_LOG")
-	if len(eventLogPath) == 0 {
-		eventLogPath = "events.log"
-	}
+// configure sets up the mapping and transform pipeline from the environment.
+// It is shared by the server and the replay command.
+func configure() {
+	var err error
 	processFilterString := os.Getenv("PS_FILTER")
 	if len(processFilterString) == 0 {
 		processFilter = 0.1
 	} else {
-		var err error
 		processFilter, err = strconv.ParseFloat(processFilterString, 64)
 		if err != nil {
 			log.Panicln(err)
 		}
 	}
+	if groupBy := os.Getenv("PS_GROUP_BY"); len(groupBy) > 0 {
+		err = checkProcessGroupBy(groupBy)
+		if err != nil {
+			log.Panicln(err)
+		}
+		processGroupBy = groupBy
+	}
+	if topN := os.Getenv("PS_TOP_N"); len(topN) > 0 {
+		processTopN, err = strconv.Atoi(topN)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	if topBy := os.Getenv("PS_TOP_BY"); len(topBy) > 0 {
+		err = checkProcessTopBy(topBy)
+		if err != nil {
+			log.Panicln(err)
+		}
+		processTopBy = topBy
+	}
+	familyRulesPath := os.Getenv("PS_FAMILY_RULES")
+	if len(familyRulesPath) > 0 {
+		familyRules, err = loadFamilyRules(familyRulesPath)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	if watch := os.Getenv("PS_WATCH"); len(watch) > 0 {
+		processTracker, err = NewProcessTracker(watch)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	scrubPatterns, err = loadScrubPatterns(os.Getenv("PS_SCRUB_PATTERNS"))
+	if err != nil {
+		log.Panicln(err)
+	}
+	if maxString := os.Getenv("PS_COMMAND_MAX"); len(maxString) > 0 {
+		commandMaxLength, err = strconv.Atoi(maxString)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
 
-	authApiKey = os.Getenv("API_KEY")
-	if len(authApiKey) == 0 {
-		log.Println("Warning: API_KEY is blank, any key is accepted")
+	diskFilter, err = LoadDiskFilter()
+	if err != nil {
+		log.Panicln(err)
 	}
+
+	statsdTypeModes, err = parseStatsdTypeModes(os.Getenv("STATSD_TYPES"))
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	maxTagKeys, _ := strconv.Atoi(os.Getenv("CARDINALITY_MAX_KEYS"))
+	maxTagValues, _ := strconv.Atoi(os.Getenv("CARDINALITY_MAX_VALUES"))
+	if maxTagKeys > 0 || maxTagValues > 0 {
+		buckets, _ := strconv.Atoi(os.Getenv("CARDINALITY_BUCKETS"))
+		cardinalityGuard, err = NewCardinalityGuard(maxTagKeys, maxTagValues, os.Getenv("CARDINALITY_ACTION"), buckets)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+
+	cumulativeMetrics := os.Getenv("CUMULATIVE_METRICS")
+	if len(cumulativeMetrics) > 0 {
+		ttl := 10 * time.Minute
+		if ttlString := os.Getenv("CUMULATIVE_TTL"); len(ttlString) > 0 {
+			ttl, err = time.ParseDuration(ttlString)
+			if err != nil {
+				log.Panicln(err)
+			}
+		}
+		derivative, err = NewDerivative(cumulativeMetrics, ttl)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+
+	for _, key := range strings.Split(os.Getenv("HOST_TAGS"), ",") {
+		key = strings.TrimSpace(key)
+		if len(key) > 0 {
+			hostTags.Keys = append(hostTags.Keys, key)
+		}
+	}
+
+	filterRulesPath := os.Getenv("FILTER_RULES")
+	if len(filterRulesPath) > 0 {
+		filterRules, err = loadFilterRules(filterRulesPath)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	relabelRulesPath := os.Getenv("RELABEL_RULES")
+	if len(relabelRulesPath) > 0 {
+		relabelRules, err = loadRelabelRules(relabelRulesPath)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+
 	inputUrl := os.Getenv("DB_URL")
 	if len(inputUrl) == 0 {
-		seriesUrl = "http://localhost:8086/db/datadog/series?u=root&p=root"
 		dbUrl = "http://localhost:8086/db?u=root&p=root"
 		dbName = "datadog"
 	} else {
 		split := strings.Split(inputUrl, "/")
 		split2 := strings.SplitN(split[4], "?", 2)
 		dbName = split2[0]
-		seriesUrl = strings.Join(split[0:4], "/") + "/" + dbName + "/series?" + split2[1]
 		dbUrl = strings.Join(split[0:4], "/") + "?" + split2[1]
 	}
-	err := CreateDBIfNotExists()
+	precision := os.Getenv("DB_PRECISION")
+	if len(precision) == 0 {
+		precision = "ms"
+	}
+	mainSink, err = NewInfluxSink(dbName, precision)
 	if err != nil {
 		log.Panicln(err)
 	}
 
+	skewMode := os.Getenv("SKEW_MODE")
+	if len(skewMode) > 0 {
+		skewWindow := 5 * time.Minute
+		if windowString := os.Getenv("SKEW_WINDOW"); len(windowString) > 0 {
+			skewWindow, err = time.ParseDuration(windowString)
+			if err != nil {
+				log.Panicln(err)
+			}
+		}
+		skewCorrector, err = NewSkewCorrector(skewMode, skewWindow)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+
+	fieldTypesPath := os.Getenv("FIELD_TYPES")
+	fieldConflict := os.Getenv("FIELD_CONFLICT")
+	if len(fieldTypesPath) > 0 || len(fieldConflict) > 0 {
+		ttl := 24 * time.Hour
+		if ttlString := os.Getenv("FIELD_TYPES_TTL"); len(ttlString) > 0 {
+			ttl, err = time.ParseDuration(ttlString)
+			if err != nil {
+				log.Panicln(err)
+			}
+		}
+		fieldTypes, err = LoadFieldTypes(fieldTypesPath, fieldConflict, ttl)
+		if err != nil {
+			log.Panicln(err)
+		}
+		if fieldTypes.Action == "quarantine" {
+			quarantineDB := os.Getenv("QUARANTINE_DB")
+			if len(quarantineDB) == 0 {
+				quarantineDB = dbName + "_quarantine"
+			}
+			fieldTypes.Quarantine = &InfluxSink{quarantineDB, precision}
+		}
+	}
+
+}
+
+func createDatabases() {
+	dbs := []string{dbName}
+	if fieldTypes != nil && fieldTypes.Quarantine != nil {
+		dbs = append(dbs, fieldTypes.Quarantine.Database)
+	}
+	for _, db := range dbs {
+		err := CreateDBIfNotExists(db)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+}
+
+func serve() {
+	listenAddr = os.Getenv("ADDR")
+	if len(listenAddr) == 0 {
+		listenAddr = ":8080"
+	}
+	eventLogPath = os.Getenv("EVENT_LOG")
+	if len(eventLogPath) == 0 {
+		eventLogPath = "events.log"
+	}
+	var err error
+	keyRateLimit, err = ParseLimits(os.Getenv("RATE_LIMIT"))
+	if err != nil {
+		log.Panicln(err)
+	}
+	hostRateLimit, err = ParseLimits(os.Getenv("HOST_RATE_LIMIT"))
+	if err != nil {
+		log.Panicln(err)
+	}
+
+	apiKeys, err = parseApiKeys(os.Getenv("API_KEY"))
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(apiKeys) == 0 {
+		log.Println("Warning: API_KEY is blank, any key is accepted")
+	}
+
+	if captureDir := os.Getenv("CAPTURE_DIR"); len(captureDir) > 0 {
+		capture, err = NewCapture(captureDir, os.Getenv("CAPTURE_HOSTS"))
+		if err != nil {
+			log.Panicln(err)
+		}
+		if sample := os.Getenv("CAPTURE_SAMPLE"); len(sample) > 0 {
+			capture.Sample, err = strconv.ParseFloat(sample, 64)
+			if err != nil {
+				log.Panicln(err)
+			}
+		}
+		if maxSize := os.Getenv("CAPTURE_MAX_SIZE"); len(maxSize) > 0 {
+			capture.MaxSize, err = strconv.ParseInt(maxSize, 10, 64)
+			if err != nil {
+				log.Panicln(err)
+			}
+		}
+		if maxFiles := os.Getenv("CAPTURE_MAX_FILES"); len(maxFiles) > 0 {
+			capture.MaxFiles, err = strconv.Atoi(maxFiles)
+			if err != nil {
+				log.Panicln(err)
+			}
+		}
+	}
+
+	createDatabases()
+
+	rollupSeries := os.Getenv("ROLLUP_SERIES")
+	if len(rollupSeries) > 0 {
+		rollupWindows := os.Getenv("ROLLUP_WINDOWS")
+		if len(rollupWindows) == 0 {
+			rollupWindows = "1m,10m,1h"
+		}
+		rollupPrecision := os.Getenv("ROLLUP_PRECISION")
+		if len(rollupPrecision) == 0 {
+			rollupPrecision = mainSink.Precision
+		}
+		rollup, err = NewRollup(rollupSeries, rollupWindows, os.Getenv("ROLLUP_DB"), rollupPrecision)
+		if err != nil {
+			log.Panicln(err)
+		}
+		for _, db := range rollup.Databases() {
+			err = CreateDBIfNotExists(db)
+			if err != nil {
+				log.Panicln(err)
+			}
+		}
+		go rollup.Run(10 * time.Second)
+	}
+
+	aggregateRulesPath := os.Getenv("AGGREGATE_RULES")
+	if len(aggregateRulesPath) > 0 {
+		aggregator, err = LoadAggregator(aggregateRulesPath)
+		if err != nil {
+			log.Panicln(err)
+		}
+		interval := time.Minute
+		if intervalString := os.Getenv("AGGREGATE_INTERVAL"); len(intervalString) > 0 {
+			interval, err = time.ParseDuration(intervalString)
+			if err != nil {
+				log.Panicln(err)
+			}
+		}
+		go aggregator.Run(interval)
+	}
+
+	alertRulesPath := os.Getenv("ALERT_RULES")
+	if len(alertRulesPath) > 0 {
+		webhooks := []string{}
+		for _, url := range strings.Split(os.Getenv("ALERT_WEBHOOKS"), ",") {
+			url = strings.TrimSpace(url)
+			if len(url) > 0 {
+				webhooks = append(webhooks, url)
+			}
+		}
+		staleAfter := time.Hour
+		if staleString := os.Getenv("ALERT_STALE_AFTER"); len(staleString) > 0 {
+			staleAfter, err = time.ParseDuration(staleString)
+			if err != nil {
+				log.Panicln(err)
+			}
+		}
+		alerter, err = LoadAlerter(alertRulesPath, webhooks, staleAfter)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+
 	eventLog, err = os.OpenFile(eventLogPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		log.Panicln(err)
 	}
 	eventsChan = make(chan []byte, 5)
 
+	hostsPath := os.Getenv("HOSTS_FILE")
+	hostInterval := 15 * time.Second
+	if intervalString := os.Getenv("HOST_INTERVAL"); len(intervalString) > 0 {
+		hostInterval, err = time.ParseDuration(intervalString)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	staleIntervals := 3
+	if staleString := os.Getenv("HOST_STALE_INTERVALS"); len(staleString) > 0 {
+		staleIntervals, err = strconv.Atoi(staleString)
+		if err != nil {
+			log.Panicln(err)
+		}
+	}
+	inventory, err = NewInventory(hostsPath, time.Duration(staleIntervals)*hostInterval)
+	if err != nil {
+		log.Panicln(err)
+	}
+	if len(hostsPath) > 0 {
+		go inventory.Run(30 * time.Second)
+	}
+
+	if timeoutString := os.Getenv("HEARTBEAT_TIMEOUT"); len(timeoutString) > 0 {
+		timeout, err := time.ParseDuration(timeoutString)
+		if err != nil {
+			log.Panicln(err)
+		}
+		heartbeat = NewHeartbeat(timeout)
+		heartbeat.Seed(inventory.Hosts())
+		go heartbeat.Run(hostInterval)
+	}
+
 	go writeEvents()
 
 	log.Println("dd-house listening on", listenAddr)
 
 	http.HandleFunc("/intake", handleIntake)
 	http.HandleFunc("/api/v1/series/", handleApi)
+	http.HandleFunc("/relabel", handleRelabel)
+	http.HandleFunc("/hosts", handleHosts)
+	http.HandleFunc("/hosts/", handleHosts)
+	http.HandleFunc("/checks", handleChecks)
+	http.HandleFunc("/agent-checks", handleAgentChecks)
+	http.HandleFunc("/alerts", handleAlerts)
+	http.HandleFunc("/field-types", handleFieldTypes)
 	log.Fatal(http.ListenAndServe(listenAddr, nil))
 }
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			configure()
+			replay(os.Args[2:])
+			return
+		case "translate":
+			configure()
+			translate(os.Args[2:])
+			return
+		}
+	}
+	configure()
+	serve()
+}
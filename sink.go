@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+)
+
+type Sink interface {
+	Push(metrics []*Metric)
+}
+
+// InfluxDB 0.8 only accepts second, millisecond and microsecond precision.
+var influxPrecisions = map[string]string{
+	"s":  "s",
+	"ms": "ms",
+	"us": "u",
+}
+
+type InfluxSink struct {
+	Database  string
+	Precision string
+}
+
+var mainSink *InfluxSink
+
+func NewInfluxSink(database, precision string) (*InfluxSink, error) {
+	if _, ok := influxPrecisions[precision]; !ok {
+		return nil, fmt.Errorf("unsupported InfluxDB time precision: %q", precision)
+	}
+	return &InfluxSink{database, precision}, nil
+}
+
+func (self *InfluxSink) Push(metrics []*Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+	log.Printf("Pushing %d metrics to InfluxDB\n", len(metrics))
+
+	body, err := json.Marshal(encodeSeries(metrics, self.Precision))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	url := SeriesUrl(self.Database) + "&time_precision=" + influxPrecisions[self.Precision]
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		log.Println(err)
+	} else if resp.StatusCode != 200 {
+		dump, _ := httputil.DumpResponse(resp, true)
+		log.Printf("Got Response: %s\n%s\n\n\n%s", resp.Status, string(body), string(dump))
+	}
+}
+
+// WriterSink writes metrics as InfluxDB 0.8 JSON with one batch per line,
+// as line protocol, or as a table for reading.
+type WriterSink struct {
+	Writer    io.Writer
+	Format    string
+	Precision string
+}
+
+func NewWriterSink(writer io.Writer, format, precision string) (*WriterSink, error) {
+	switch format {
+	case "json", "line", "table":
+	default:
+		return nil, fmt.Errorf("unknown output format: %q", format)
+	}
+	if _, ok := precisionUnits[precision]; !ok {
+		return nil, fmt.Errorf("unknown time precision: %q", precision)
+	}
+	return &WriterSink{writer, format, precision}, nil
+}
+
+func (self *WriterSink) Push(metrics []*Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+	var body []byte
+	switch self.Format {
+	case "line":
+		for _, metric := range metrics {
+			for _, line := range EncodeLines(metric, self.Precision) {
+				body = append(body, line+"\n"...)
+			}
+		}
+	case "table":
+		body = encodeTable(metrics)
+	default:
+		var err error
+		body, err = json.Marshal(encodeSeries(metrics, self.Precision))
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		body = append(body, '\n')
+	}
+	_, err := self.Writer.Write(body)
+	if err != nil {
+		log.Println(err)
+	}
+}
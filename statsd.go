@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The unit each statsd type is reported in by the agent. Types not listed
+// here, such as gauges, are always written as sent.
+var statsdNativeModes = map[string]string{
+	"count": "per_interval",
+	"rate":  "per_second",
+}
+
+var statsdTypeModes = map[string]string{}
+
+// STATSD_TYPES is a comma separated list of type=mode, where mode is one of
+// raw, per_second, per_interval or both, e.g. "count=both,rate=per_second".
+// Only count and rate can be converted.
+func parseStatsdTypeModes(s string) (map[string]string, error) {
+	modes := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		split := strings.SplitN(entry, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid statsd type mode: %q", entry)
+		}
+		switch split[1] {
+		case "raw", "per_second", "per_interval", "both":
+		default:
+			return nil, fmt.Errorf("unknown statsd type mode: %q", split[1])
+		}
+		if _, ok := statsdNativeModes[split[0]]; !ok && split[1] != "raw" {
+			return nil, fmt.Errorf("statsd type %q is always written as sent and can't be converted to %s", split[0], split[1])
+		}
+		modes[split[0]] = split[1]
+	}
+	return modes, nil
+}
+
+func statsdTypeMode(metricType string) string {
+	if _, ok := statsdNativeModes[metricType]; !ok {
+		return "raw"
+	}
+	mode, ok := statsdTypeModes[metricType]
+	if !ok {
+		return "raw"
+	}
+	return mode
+}
+
+// Returns the value converted to mode. When mode is "both" the value is per
+// second and the second result is the per interval value.
+func normalizeStatsdValue(metricType, mode string, interval float64, value interface{}) (interface{}, interface{}) {
+	v, ok := value.(float64)
+	if !ok || interval <= 0 || mode == "raw" {
+		return value, nil
+	}
+
+	perSecond, perInterval := v, v
+	if statsdNativeModes[metricType] == "per_interval" {
+		perSecond = v / interval
+	} else {
+		perInterval = v * interval
+	}
+
+	switch mode {
+	case "per_second":
+		return perSecond, nil
+	case "per_interval":
+		return perInterval, nil
+	}
+	return perSecond, perInterval
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Timestamps are kept in nanoseconds internally, and converted to the
+// precision of each sink when written.
+func agentTimestamp(seconds float64) uint64 {
+	return uint64(seconds * float64(time.Second))
+}
+
+func timeToTimestamp(t time.Time) uint64 {
+	return uint64(t.UnixNano())
+}
+
+func timestampToTime(timestamp uint64) time.Time {
+	return time.Unix(0, int64(timestamp))
+}
+
+var precisionUnits = map[string]uint64{
+	"s":  uint64(time.Second),
+	"ms": uint64(time.Millisecond),
+	"us": uint64(time.Microsecond),
+	"ns": uint64(time.Nanosecond),
+}
+
+func convertTimestamp(timestamp uint64, precision string) uint64 {
+	return timestamp / precisionUnits[precision]
+}
+
+// SkewCorrector compares the timestamp of each payload to the time it was
+// received. Points further than Window from the receive time are shifted by
+// the payload's skew in "rewrite" mode, or dropped in "reject" mode. The skew
+// of every payload is recorded in the host.clock_skew series.
+type SkewCorrector struct {
+	Mode   string
+	Window time.Duration
+}
+
+var skewCorrector *SkewCorrector
+
+func NewSkewCorrector(mode string, window time.Duration) (*SkewCorrector, error) {
+	switch mode {
+	case "measure", "rewrite", "reject":
+	default:
+		return nil, fmt.Errorf("unknown skew mode: %q", mode)
+	}
+	return &SkewCorrector{mode, window}, nil
+}
+
+func (self *SkewCorrector) Apply(metrics []*Metric, host string, payload uint64, received time.Time) []*Metric {
+	if payload == 0 {
+		return metrics
+	}
+	now := timeToTimestamp(received)
+	skew := int64(payload) - int64(now)
+
+	if self.Mode != "measure" {
+		window := float64(self.Window)
+		kept := metrics[:0]
+		for _, metric := range metrics {
+			points := metric.Points[:0]
+			for _, point := range metric.Points {
+				if math.Abs(float64(int64(point.Time)-int64(now))) > window {
+					if self.Mode == "reject" {
+						continue
+					}
+					point.Time = uint64(int64(point.Time) - skew)
+				}
+				points = append(points, point)
+			}
+			metric.Points = points
+			if len(points) > 0 {
+				kept = append(kept, metric)
+			}
+		}
+		metrics = kept
+	}
+
+	point := NewPoint(now, host)
+	point.SetField("value", time.Duration(skew).Seconds())
+	return append(metrics, &Metric{"host.clock_skew", []*Point{point}})
+}
+
+// The statsd payload carries no timestamp of its own, so the newest point
+// stands in for it.
+func latestTimestamp(metrics []*Metric) uint64 {
+	latest := uint64(0)
+	for _, metric := range metrics {
+		for _, point := range metric.Points {
+			if point.Time > latest {
+				latest = point.Time
+			}
+		}
+	}
+	return latest
+}
+
+func correctSkew(metrics []*Metric, host string, payload uint64, received time.Time) []*Metric {
+	if skewCorrector == nil {
+		return metrics
+	}
+	return skewCorrector.Apply(metrics, host, payload, received)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Orders metrics by name and their points by time and tags, so that the same
+// payload always prints the same way.
+func sortMetrics(metrics []*Metric) {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].Name < metrics[j].Name
+	})
+	for _, metric := range metrics {
+		points := metric.Points
+		sort.SliceStable(points, func(i, j int) bool {
+			if points[i].Time != points[j].Time {
+				return points[i].Time < points[j].Time
+			}
+			return points[i].SeriesKey("") < points[j].SeriesKey("")
+		})
+	}
+}
+
+// Strings that would break up the table are quoted.
+func tableValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "-"
+	case string:
+		if len(v) == 0 || strings.ContainsAny(v, "\t\n\r") {
+			return strconv.Quote(v)
+		}
+		return v
+	}
+	return fmt.Sprint(value)
+}
+
+func encodeTable(metrics []*Metric) []byte {
+	buf := &bytes.Buffer{}
+	for _, metric := range metrics {
+		series := EncodeSeries(metric, "ns")
+		fmt.Fprintf(buf, "%s (%d points)\n", series.Name, len(series.Points))
+		w := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+		for i, column := range series.Columns {
+			if i > 0 {
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprint(w, column)
+		}
+		fmt.Fprintln(w)
+		for _, point := range series.Points {
+			for i, value := range point {
+				if i > 0 {
+					fmt.Fprint(w, "\t")
+				}
+				if i == 0 {
+					fmt.Fprint(w, timestampToTime(value.(uint64)).UTC().Format(time.RFC3339Nano))
+				} else {
+					fmt.Fprint(w, tableValue(value))
+				}
+			}
+			fmt.Fprintln(w)
+		}
+		w.Flush()
+		fmt.Fprintln(buf)
+	}
+	return buf.Bytes()
+}
+
+// Recognises zlib and gzip streams by their header bytes.
+func detectEncoding(reader *bufio.Reader) string {
+	header, err := reader.Peek(2)
+	if err != nil {
+		return "none"
+	}
+	if header[0] == 0x1f && header[1] == 0x8b {
+		return "gzip"
+	}
+	if header[0]&0x0f == 8 && (uint(header[0])<<8|uint(header[1]))%31 == 0 {
+		return "deflate"
+	}
+	return "none"
+}
+
+func detectPayloadPath(body []byte) (string, error) {
+	keys := make(map[string]json.RawMessage)
+	err := json.Unmarshal(body, &keys)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := keys["series"]; ok {
+		return "/api/v1/series/", nil
+	}
+	return "/intake", nil
+}
+
+// translate implements "dd-house translate [flags] [file]", which prints what
+// dd-house would write for an intake or series payload.
+func translate(args []string) {
+	flags := flag.NewFlagSet("translate", flag.ExitOnError)
+	format := flags.String("format", "table", "output format: json (InfluxDB 0.8), line or table")
+	payloadType := flags.String("type", "auto", "payload type: auto, intake or series")
+	encoding := flags.String("encoding", "auto", "payload encoding: auto, none, deflate or gzip")
+	precision := flags.String("precision", "", "time precision: s, ms, us or ns (default DB_PRECISION)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: dd-house translate [flags] [file]")
+		fmt.Fprintln(os.Stderr, "Reads the payload from stdin if no file is given.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if len(*precision) == 0 {
+		*precision = mainSink.Precision
+	}
+	disableQuarantine()
+	sink, err := NewWriterSink(os.Stdout, *format, *precision)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var input io.Reader = os.Stdin
+	if path := flags.Arg(0); len(path) > 0 && path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer file.Close()
+		input = file
+	}
+	reader := bufio.NewReader(input)
+	if *encoding == "auto" {
+		*encoding = detectEncoding(reader)
+	}
+	switch *encoding {
+	case "none", "deflate", "gzip":
+	default:
+		log.Fatalf("unknown payload encoding: %q\n", *encoding)
+	}
+	decoded, err := decompress(reader, *encoding)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	body, err := io.ReadAll(decoded)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var path string
+	switch *payloadType {
+	case "auto":
+		path, err = detectPayloadPath(body)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	case "intake":
+		path = "/intake"
+	case "series":
+		path = "/api/v1/series/"
+	default:
+		log.Fatalf("unknown payload type: %q\n", *payloadType)
+	}
+
+	metrics, err := payloadMetrics(path, body, time.Now())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	sortMetrics(metrics)
+	sink.Push(metrics)
+}